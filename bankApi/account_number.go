@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"math/big"
+)
+
+// Account numbers are 9 random digits followed by a Luhn check digit, so a mistyped
+// digit is caught before it ever reaches the database
+const (
+	accountNumberPayloadMin = 100000000
+	accountNumberPayloadMax = 999999999
+
+	maxAccountNumberAttempts = 5
+
+	// legacyAccountNumberMax is the largest number handed out before check digits, those
+	// accounts keep their numbers and skip the Luhn check
+	legacyAccountNumberMax = 9999999
+)
+
+var ErrAccountNumberTaken = errors.New("account number already taken")
+
+func generateAccountNumber() (int64, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(accountNumberPayloadMax-accountNumberPayloadMin+1))
+	if err != nil {
+		return 0, err
+	}
+
+	payload := n.Int64() + accountNumberPayloadMin
+	return payload*10 + luhnCheckDigit(payload), nil
+}
+
+// luhnCheckDigit returns the digit that makes payload followed by it pass the Luhn check
+func luhnCheckDigit(payload int64) int64 {
+	sum := int64(0)
+	double := true
+
+	for ; payload > 0; payload /= 10 {
+		digit := payload % 10
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+
+	return (10 - sum%10) % 10
+}
+
+func validLuhn(number int64) bool {
+	return number > 9 && luhnCheckDigit(number/10) == number%10
+}
+
+// validAccountNumber accepts Luhn-checked numbers and the legacy ones without a check digit
+func validAccountNumber(number int64) bool {
+	return (number > 0 && number <= legacyAccountNumberMax) || validLuhn(number)
+}
+
+// createWithUniqueNumber calls insert until it stops reporting ErrAccountNumberTaken,
+// drawing a new account number for every retry
+func createWithUniqueNumber(ctx context.Context, account *Account, insert func(context.Context, *Account) (*Account, error)) (*Account, error) {
+	for attempt := 1; ; attempt++ {
+		created, err := insert(ctx, account)
+		if !errors.Is(err, ErrAccountNumberTaken) || attempt == maxAccountNumberAttempts {
+			return created, err
+		}
+
+		number, err := generateAccountNumber()
+		if err != nil {
+			return nil, err
+		}
+		account.Number = number
+	}
+}
@@ -1,249 +1,760 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"strconv"
+	"strings"
+	"time"
 
-	jwt "github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func WriteJson(w http.ResponseWriter, status int, v any) error {
-	w.WriteHeader(status)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	return json.NewEncoder(w).Encode(v)
 }
 
 type APIfunc func(http.ResponseWriter, *http.Request) error
 
-type ApiError struct {
-	Error string `json:"error"`
-}
-
-type TokenResponse struct {
-	Token string `json:"token"`
-}
-
 // handling error since handler function does not return error but our api function do
 func httpHandleFunc(f APIfunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := f(w, r); err != nil {
-			// handle err
-			WriteJson(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+			// drivers don't always wrap the context error, report the cancellation itself
+			if ctxErr := r.Context().Err(); ctxErr != nil {
+				err = ctxErr
+			}
+			writeError(w, err)
 		}
 	}
 }
 
 type APIServer struct {
-	listenAddr string
-	store      Storage
+	config    *Config
+	store     Storage
+	rates     *RateTable
+	jwtSecret []byte
+
+	// now is the clock login backoff is measured with
+	now func() time.Time
+
+	// statements holds a slot for every statement being streamed, see MaxStatements
+	statements chan struct{}
 }
 
-func newAPIServer(listenAddr string, store Storage) *APIServer {
+func newAPIServer(config *Config, store Storage, rates *RateTable) *APIServer {
 	return &APIServer{
-		listenAddr: listenAddr,
-		store:      store,
+		config:    config,
+		store:     store,
+		rates:     rates,
+		jwtSecret: []byte(config.JWTSecret),
+		now:       time.Now,
+
+		statements: make(chan struct{}, config.MaxStatements),
+	}
+}
+
+// Run serves until ctx is cancelled, then stops accepting connections and waits up to
+// the shutdown timeout for in-flight requests to finish
+func (s *APIServer) Run(ctx context.Context) error {
+	server := &http.Server{
+		Addr:         s.config.ListenAddr,
+		Handler:      s.Handler(),
+		ReadTimeout:  s.config.ReadTimeout,
+		WriteTimeout: s.config.WriteTimeout,
+		IdleTimeout:  s.config.IdleTimeout,
+	}
+
+	serveErr := make(chan error, 1)
+
+	schedulerCtx, stopScheduler := context.WithCancel(ctx)
+	schedulerDone := make(chan struct{})
+	go func() {
+		defer close(schedulerDone)
+		s.runScheduler(schedulerCtx, s.config.SchedulerInterval)
+	}()
+
+	// the scheduler has to be finished before main closes the store
+	defer func() {
+		stopScheduler()
+		<-schedulerDone
+	}()
+
+	go func() {
+		log.Println("Server is running on Port ", s.config.ListenAddr)
+
+		if s.config.TLS.Enabled() {
+			serveErr <- server.ListenAndServeTLS(s.config.TLS.CertFile, s.config.TLS.KeyFile)
+			return
+		}
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down, waiting for in-flight requests")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	log.Println("Server stopped")
+	return nil
+}
+
+// withRequestTimeout gives every request a deadline that storage calls inherit through its context
+func withRequestTimeout(timeout func(*http.Request) time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout(r))
+			defer cancel()
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
 	}
 }
 
-func (s *APIServer) Run() {
+// Handler builds the router serving every API route
+func (s *APIServer) Handler() http.Handler {
 	router := mux.NewRouter()
+	router.Use(withRequestTimeout(s.requestTimeout))
+
+	staff := hasRole(RoleTeller, RoleAdmin)
+	admin := hasRole(RoleAdmin)
 
 	router.HandleFunc("/login", httpHandleFunc(s.handleLogin)).Methods("POST")
-	router.HandleFunc("/account", httpHandleFunc(s.handleGetAccounts)).Methods("GET")
-	router.HandleFunc("/account/{id}", httpHandleFunc(s.handleGetAccount)).Methods("GET")
+	router.HandleFunc("/login/2fa", httpHandleFunc(s.handleTwoFactorLogin)).Methods("POST")
+	router.HandleFunc("/token/refresh", httpHandleFunc(s.handleRefreshToken)).Methods("POST")
+	router.HandleFunc("/logout", httpHandleFunc(s.handleLogout)).Methods("POST")
+	router.HandleFunc("/account", s.withJWTAuth(authorize(httpHandleFunc(s.handleGetAccounts), admin))).Methods("GET")
+	router.HandleFunc("/account/{id}", s.withJWTAuth(authorize(httpHandleFunc(s.handleGetAccount), ownsAccount, staff))).Methods("GET")
 	router.HandleFunc("/account", httpHandleFunc(s.handleCreateAccount)).Methods("POST")
-	router.HandleFunc("/account/{id}", withJWTAuth(httpHandleFunc(s.handleDeleteAccount), s.store)).Methods("DELETE")
-	router.HandleFunc("/transfer", withJWTAuth(httpHandleFunc(s.handleTransfer), s.store)).Methods("POST")
-
-	log.Println("Server is running on Port ", s.listenAddr)
-	log.Fatal(http.ListenAndServe(s.listenAddr, router))
+	router.HandleFunc("/account/{id}", s.withJWTAuth(authorize(httpHandleFunc(s.handleDeleteAccount), ownsAccount, admin))).Methods("DELETE")
+	router.HandleFunc("/account/{id}", s.withJWTAuth(authorize(httpHandleFunc(s.handleUpdateAccount), ownsAccount, admin))).Methods("PATCH")
+	router.HandleFunc("/account/{id}/password", s.withJWTAuth(authorize(httpHandleFunc(s.handleChangePassword), ownsAccount))).Methods("POST")
+	router.HandleFunc("/account/{id}/2fa", s.withJWTAuth(authorize(httpHandleFunc(s.handleEnrollTwoFactor), ownsAccount))).Methods("POST")
+	router.HandleFunc("/account/{id}/2fa/confirm", s.withJWTAuth(authorize(httpHandleFunc(s.handleConfirmTwoFactor), ownsAccount))).Methods("POST")
+	router.HandleFunc("/account/{id}/2fa/disable", s.withJWTAuth(authorize(httpHandleFunc(s.handleDisableTwoFactor), ownsAccount))).Methods("POST")
+	router.HandleFunc("/account/{id}/freeze", s.withJWTAuth(authorize(httpHandleFunc(s.handleFreezeAccount), ownsAccount, admin))).Methods("POST")
+	router.HandleFunc("/account/{id}/close", s.withJWTAuth(authorize(httpHandleFunc(s.handleCloseAccount), ownsAccount, admin))).Methods("POST")
+	router.HandleFunc("/account/{id}/reopen", s.withJWTAuth(authorize(httpHandleFunc(s.handleReopenAccount), admin))).Methods("POST")
+	router.HandleFunc("/account/{id}/role", s.withJWTAuth(authorize(httpHandleFunc(s.handleUpdateRole), admin))).Methods("PUT")
+	router.HandleFunc("/account/{id}/deposit", s.withJWTAuth(authorize(withIdempotency(httpHandleFunc(s.handleDeposit), s.store), ownsAccount, staff))).Methods("POST")
+	router.HandleFunc("/account/{id}/withdraw", s.withJWTAuth(authorize(withIdempotency(httpHandleFunc(s.handleWithdraw), s.store), ownsAccount))).Methods("POST")
+	router.HandleFunc("/account/{id}/statement", s.withJWTAuth(authorize(httpHandleFunc(s.handleGetStatement), ownsAccount, staff))).Methods("GET").Name(statementRoute)
+	router.HandleFunc("/account/{id}/transactions", s.withJWTAuth(authorize(httpHandleFunc(s.handleGetTransactions), ownsAccount, staff))).Methods("GET")
+	router.HandleFunc("/rates", s.withJWTAuth(httpHandleFunc(s.handleGetRates))).Methods("GET")
+	router.HandleFunc("/rates", s.withJWTAuth(authorize(httpHandleFunc(s.handleSetRates), admin))).Methods("PUT")
+	router.HandleFunc("/transfer", s.withJWTAuth(withIdempotency(httpHandleFunc(s.handleTransfer), s.store))).Methods("POST")
+	router.HandleFunc("/transfer/schedules", s.withJWTAuth(httpHandleFunc(s.handleGetSchedules))).Methods("GET")
+	router.HandleFunc("/transfer/schedules", s.withJWTAuth(withIdempotency(httpHandleFunc(s.handleCreateSchedule), s.store))).Methods("POST")
+	router.HandleFunc("/transfer/schedules/{id}", s.withJWTAuth(httpHandleFunc(s.handleGetSchedule))).Methods("GET")
+	router.HandleFunc("/transfer/schedules/{id}/runs", s.withJWTAuth(httpHandleFunc(s.handleGetScheduleRuns))).Methods("GET")
+	router.HandleFunc("/transfer/schedules/{id}/pause", s.withJWTAuth(httpHandleFunc(s.handlePauseSchedule))).Methods("POST")
+	router.HandleFunc("/transfer/schedules/{id}/resume", s.withJWTAuth(httpHandleFunc(s.handleResumeSchedule))).Methods("POST")
+	router.HandleFunc("/transfer/schedules/{id}/cancel", s.withJWTAuth(httpHandleFunc(s.handleCancelSchedule))).Methods("POST")
+	return router
 }
 
-func withJWTAuth(handlerFunc http.HandlerFunc, s Storage) http.HandlerFunc {
+func (s *APIServer) handleLogin(w http.ResponseWriter, r *http.Request) error {
+	
+	req := new(LoginRequest)
+	err := decodeJSON(w, r, req)
+
+	if err != nil {
+		return err
+	}
 
-	return func(w http.ResponseWriter, r *http.Request) {
+	keys := loginKeys(r, req.Number)
 
-		tokenString := r.Header.Get("token")
+	reservations, err := s.reserveLoginAttempt(r.Context(), w, keys)
+	if err != nil {
+		return err
+	}
 
-		token, err := validateJWT(tokenString)
+	account, err := s.store.LoginAccount(r.Context(), req)
 
-		if err != nil {
-			log.Println("invalid token")
-			WriteJson(w, http.StatusUnauthorized, ApiError{Error: "permission denied"})
-			return
-		}
+	// a wrong password keeps the failure reserved for it
+	if errors.Is(err, ErrInvalidCredentials) {
+		return err
+	}
 
-		if !token.Valid {
-			log.Println("invalid token")
-			WriteJson(w, http.StatusUnauthorized, ApiError{Error: "permission denied"})
-			return
-		}
+	if err != nil {
+		s.releaseLoginAttempt(r.Context(), reservations)
+		return err
+	}
 
-		userID, err := getID(r)
+	// the password was right, this try doesn't count against the account or the IP
+	s.releaseLoginAttempt(r.Context(), reservations)
 
-		if err != nil {
-			log.Println("invalid id")
-			WriteJson(w, http.StatusUnauthorized, ApiError{Error: "permission denied"})
-			return
-		}
+	tf, err := s.enabledTwoFactor(r.Context(), account.Number)
+
+	if err != nil {
+		return err
+	}
 
-		claims := token.Claims.(jwt.MapClaims)
-		
-		account, err := s.GetAccountByID(userID)
+	// the failures are only forgotten once the second factor is right too, otherwise the
+	// password alone would buy unlimited guesses at the code
+	if tf != nil {
+		challenge, expiresAt, err := createChallengeJWT(account, s.jwtSecret)
 
-		if account.Number != int64(claims["accountNumber"].(float64)) {
-			log.Println("invalid token")
-			WriteJson(w, http.StatusForbidden, ApiError{Error: "permission denied"})
-			return
-		}
-		
 		if err != nil {
-			log.Println("invalid token")
-			WriteJson(w, http.StatusForbidden, ApiError{Error: "invalid token"})
-			return
+			return err
 		}
 
-		handlerFunc(w, r)
+		return WriteJson(w, http.StatusOK, ChallengeResponse{TwoFactorRequired: true, ChallengeToken: challenge, ExpiresAt: expiresAt})
 	}
-} 
-
-func validateJWT(tokenString string) (*jwt.Token, error) {
 
-	secret := os.Getenv("SECRET")
+	// only the account's counter, a success must not wipe out failures from the same IP
+	if err := s.store.ResetLoginAttempts(r.Context(), keys[0].key); err != nil {
+		return err
+	}
+	tokens, err := s.issueTokens(r.Context(), account)
 
-	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// Don't forget to validate the alg is what you expect:
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
+	if err != nil {
+		return err
+	}
 
-		// hmacSampleSecret is a []byte containing your secret, e.g. []byte("my_secret_key")
-		return []byte(secret), nil
-	})
+	return WriteJson(w, http.StatusOK, tokens)
 }
 
-func createJWT(account *Account) (string, error) {
-	 claims := &jwt.MapClaims{
-		"expiresAt": 15000,
-		"accountNumber": account.Number,
+func (s *APIServer) handleGetAccounts(w http.ResponseWriter, r *http.Request) error {
+	filter, err := getAccountFilter(r)
+
+	if err != nil {
+		return err
 	}
 
-	secret := os.Getenv("SECRET")
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	
-	return token.SignedString([]byte(secret))
+	page, err := s.store.GetAccounts(r.Context(), filter)
+
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+
+	if page.Next != nil {
+		next := *r.URL
+		query := next.Query()
+		query.Set("cursor", encodeCursor(page.Next))
+		next.RawQuery = query.Encode()
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.RequestURI()))
+	}
+
+	return WriteJson(w, http.StatusOK, page.Accounts)
 }
 
-func (s *APIServer) handleLogin(w http.ResponseWriter, r *http.Request) error {
-	
-	req := new(LoginRequest)
-	err := json.NewDecoder(r.Body).Decode(req)
+func (s *APIServer) handleGetAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
 
 	if err != nil {
 		return err
 	}
 
-	tokenString, err := s.store.LoginAccount(req)
+	account, err := s.store.GetAccountByID(r.Context(), id)
 
 	if err != nil {
 		return err
 	}
 
-	return WriteJson(w, http.StatusOK, TokenResponse{Token: tokenString})
+	w.Header().Set("ETag", accountETag(account))
+	return WriteJson(w, http.StatusOK, account)
 }
 
-func (s *APIServer) handleGetAccounts(w http.ResponseWriter, r *http.Request) error {
-	accounts, err := s.store.GetAccounts()
+// handleUpdateAccount changes profile fields, the client has to send the ETag it last saw as If-Match
+func (s *APIServer) handleUpdateAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+
+	if err != nil {
+		return err
+	}
+
+	version, err := ifMatchVersion(r)
+
+	if err != nil {
+		return err
+	}
+
+	if version == 0 {
+		return newAPIError(http.StatusPreconditionRequired, CodeVersionRequired, "If-Match header with the account's ETag is required")
+	}
+
+	req := new(UpdateAccountRequest)
+	if err := decodeJSON(w, r, req); err != nil {
+		return err
+	}
+
+	if req.FirstName == nil && req.LastName == nil {
+		return validationError("nothing to update")
+	}
+
+	account, err := s.store.UpdateAccount(r.Context(), id, &AccountUpdate{FirstName: req.FirstName, LastName: req.LastName}, version)
 
 	if err != nil {
 		return err
 	}
 
-	return WriteJson(w, http.StatusOK, accounts)
+	w.Header().Set("ETag", accountETag(account))
+	return WriteJson(w, http.StatusOK, account)
 }
 
-func (s *APIServer) handleGetAccount(w http.ResponseWriter, r *http.Request) error {
+// handleChangePassword re-hashes the password once the current one checks out and logs out
+// every other session. If-Match is optional here since the current password already proves intent.
+func (s *APIServer) handleChangePassword(w http.ResponseWriter, r *http.Request) error {
 	id, err := getID(r)
 
 	if err != nil {
 		return err
 	}
 
-	account, err := s.store.GetAccountByID(id)
+	version, err := ifMatchVersion(r)
 
 	if err != nil {
 		return err
 	}
 
+	req := new(ChangePasswordRequest)
+	if err := decodeJSON(w, r, req); err != nil {
+		return err
+	}
+
+	account, err := s.store.GetAccountByID(r.Context(), id)
+
+	if err != nil {
+		return err
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(account.EncryptedPassword), []byte(req.CurrentPassword)); err != nil {
+		apiErr := validationError("current password is incorrect")
+		apiErr.Fields = map[string]string{"currentPassword": "is incorrect"}
+		return apiErr
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), passwordCost)
+
+	if err != nil {
+		return err
+	}
+
+	encrypted := string(hash)
+	account, err = s.store.UpdateAccount(r.Context(), id, &AccountUpdate{EncryptedPassword: &encrypted}, version)
+
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.RevokeAccountRefreshTokens(r.Context(), account.Number); err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", accountETag(account))
 	return WriteJson(w, http.StatusOK, account)
 }
 
+func accountETag(account *Account) string {
+	return fmt.Sprintf(`"%d"`, account.Version)
+}
+
+// ifMatchVersion returns the account version named by If-Match, 0 when the header is missing
+func ifMatchVersion(r *http.Request) (int, error) {
+	val := r.Header.Get("If-Match")
+	if val == "" {
+		return 0, nil
+	}
+
+	version, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(val, "W/"), `"`))
+	if err != nil || version < 1 {
+		return 0, validationError("If-Match should be an account ETag")
+	}
+
+	return version, nil
+}
+
 func (s *APIServer) handleCreateAccount(w http.ResponseWriter, r *http.Request) error {
 
 	createAccount := new(CreateAccountRequest)
-	if err := json.NewDecoder(r.Body).Decode(createAccount); err != nil {
+	if err := decodeJSON(w, r, createAccount); err != nil {
 		return err
 	}
 
-	if len(createAccount.Password) < 6 {
-		return fmt.Errorf("password should have more than 6 characters")
+	currency := createAccount.Currency
+	if currency == "" {
+		currency = DefaultCurrency
 	}
 
-	account := NewAccount(createAccount.FirstName, createAccount.LastName, createAccount.Password)
+	account := NewAccount(createAccount.FirstName, createAccount.LastName, createAccount.Password, currency)
 
 	if account == nil {
-		return fmt.Errorf("account could not be created")
+		return internalError(fmt.Errorf("account could not be created"))
 	}
 
-	accountCreated, err := s.store.CreateAccount(account)
+	accountCreated, err := s.store.CreateAccount(r.Context(), account)
 
 	if err != nil {
 		return err
 	}
 
-	tokenString, err := createJWT(accountCreated) 
+	tokens, err := s.issueTokens(r.Context(), accountCreated)
 
 	if err != nil {
 		return err
 	}
 
-	log.Println("JWT: ", tokenString)
-	r.Header.Add("token", tokenString)
-
-	return WriteJson(w, http.StatusOK, TokenResponse{Token: tokenString})
+	return WriteJson(w, http.StatusOK, tokens)
 }
 
+// handleDeleteAccount closes the account, the row is kept for audit. The reason may be given as ?reason=
 func (s *APIServer) handleDeleteAccount(w http.ResponseWriter, r *http.Request) error {
 
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "closed on request"
+	}
+
+	return s.changeStatus(w, r, StatusClosed, reason)
+}
+
+func (s *APIServer) handleFreezeAccount(w http.ResponseWriter, r *http.Request) error {
+	return s.handleStatusChange(w, r, StatusFrozen)
+}
+
+func (s *APIServer) handleCloseAccount(w http.ResponseWriter, r *http.Request) error {
+	return s.handleStatusChange(w, r, StatusClosed)
+}
+
+// handleReopenAccount thaws a frozen account, closed accounts stay closed
+func (s *APIServer) handleReopenAccount(w http.ResponseWriter, r *http.Request) error {
+	return s.handleStatusChange(w, r, StatusActive)
+}
+
+func (s *APIServer) handleStatusChange(w http.ResponseWriter, r *http.Request, status AccountStatus) error {
+
+	req := new(StatusChangeRequest)
+	if err := decodeJSON(w, r, req); err != nil {
+		return err
+	}
+
+	return s.changeStatus(w, r, status, req.Reason)
+}
+
+func (s *APIServer) changeStatus(w http.ResponseWriter, r *http.Request, status AccountStatus, reason string) error {
+
 	id, err := getID(r)
 
 	if err != nil {
 		return err
 	}
 
-	err = s.store.DeleteAccount(id)
+	account, err := s.store.ChangeAccountStatus(r.Context(), id, status, reason)
+
 	if err != nil {
-		return nil
+		return err
 	}
 
-	return nil
+	// a closed account has no business holding on to sessions
+	if status == StatusClosed {
+		if err := s.store.RevokeAccountRefreshTokens(r.Context(), account.Number); err != nil {
+			return err
+		}
+	}
+
+	w.Header().Set("ETag", accountETag(account))
+	return WriteJson(w, http.StatusOK, account)
 }
 
 func (s *APIServer) handleTransfer(w http.ResponseWriter, r *http.Request) error {
 
 	transferData := new(TransferRequest)
 
-	err := json.NewDecoder(r.Body).Decode(transferData)
+	err := decodeJSON(w, r, transferData)
+	if err != nil {
+		return err
+	}
+
+	if err := s.requireStepUp(w, r, transferData.Money()); err != nil {
+		return err
+	}
+
+	caller := callerFromContext(r.Context())
+
+	account, err := s.store.Transfer(r.Context(), caller.Number, transferData, s.rates)
+	if err != nil {
+		return err
+	}
+
+	return WriteJson(w, http.StatusOK, account)
+}
+
+// handleUpdateRole lets an admin change another account's role
+func (s *APIServer) handleUpdateRole(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+
+	if err != nil {
+		return err
+	}
+
+	req := new(RoleRequest)
+	if err := decodeJSON(w, r, req); err != nil {
+		return err
+	}
+
+	if !req.Role.Valid() {
+		return validationError(fmt.Sprintf("unknown role %q", req.Role))
+	}
+
+	if id == callerFromContext(r.Context()).ID {
+		return forbidden("cannot change your own role")
+	}
+
+	account, err := s.store.UpdateAccountRole(r.Context(), id, req.Role)
+
+	if err != nil {
+		return err
+	}
+
+	return WriteJson(w, http.StatusOK, account)
+}
+
+func (s *APIServer) handleDeposit(w http.ResponseWriter, r *http.Request) error {
+	return s.handleBalanceChange(w, r, s.store.Deposit)
+}
+
+func (s *APIServer) handleWithdraw(w http.ResponseWriter, r *http.Request) error {
+	return s.handleBalanceChange(w, r, s.store.Withdraw)
+}
+
+func (s *APIServer) handleBalanceChange(w http.ResponseWriter, r *http.Request, change func(context.Context, int, Money) (*Account, error)) error {
+	id, err := getID(r)
+
+	if err != nil {
+		return err
+	}
+
+	req := new(AmountRequest)
+	if err := decodeJSON(w, r, req); err != nil {
+		return err
+	}
+
+	account, err := change(r.Context(), id, req.Money())
+
+	if err != nil {
+		return err
+	}
+
+	return WriteJson(w, http.StatusOK, account)
+}
+
+// handleGetTransactions lists an account's ledger entries, paged with limit/offset
+// and optionally bounded by from/to (RFC 3339 or YYYY-MM-DD, to is exclusive for timestamps and inclusive for dates)
+func (s *APIServer) handleGetTransactions(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+
+	if err != nil {
+		return err
+	}
+
+	account, err := s.store.GetAccountByID(r.Context(), id)
+
+	if err != nil {
+		return err
+	}
+
+	filter, err := getTransactionFilter(r)
+
+	if err != nil {
+		return err
+	}
+
+	transactions, err := s.store.GetTransactions(r.Context(), account.Number, filter)
+
 	if err != nil {
 		return err
 	}
 
-	return WriteJson(w, http.StatusOK, transferData)
+	return WriteJson(w, http.StatusOK, transactions)
+}
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 100
+)
+
+func getTransactionFilter(r *http.Request) (*TransactionFilter, error) {
+	query := r.URL.Query()
+	filter := &TransactionFilter{Limit: defaultPageLimit}
+
+	if val := query.Get("limit"); val != "" {
+		limit, err := strconv.Atoi(val)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return nil, validationError(fmt.Sprintf("limit should be between 1 and %d", maxPageLimit))
+		}
+		filter.Limit = limit
+	}
+
+	if val := query.Get("offset"); val != "" {
+		offset, err := strconv.Atoi(val)
+		if err != nil || offset < 0 {
+			return nil, validationError("offset should be a non-negative number")
+		}
+		filter.Offset = offset
+	}
+
+	var err error
+
+	if filter.From, err = parseDate(query.Get("from"), false); err != nil {
+		return nil, validationError("invalid from date")
+	}
+
+	if filter.To, err = parseDate(query.Get("to"), true); err != nil {
+		return nil, validationError("invalid to date")
+	}
+
+	return filter, nil
+}
+
+// getAccountFilter reads the GET /account query, sort is created_at, balance or name
+// and order is asc or desc. cursor continues from the Link header of the previous page.
+func getAccountFilter(r *http.Request) (*AccountFilter, error) {
+	query := r.URL.Query()
+	filter := &AccountFilter{Limit: defaultPageLimit, Sort: SortCreatedAt}
+
+	if val := query.Get("limit"); val != "" {
+		limit, err := strconv.Atoi(val)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return nil, validationError(fmt.Sprintf("limit should be between 1 and %d", maxPageLimit))
+		}
+		filter.Limit = limit
+	}
+
+	if val := query.Get("sort"); val != "" {
+		filter.Sort = AccountSort(val)
+		if !filter.Sort.Valid() {
+			return nil, validationError("sort should be created_at, balance or name")
+		}
+	}
+
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		filter.Desc = true
+	default:
+		return nil, validationError("order should be asc or desc")
+	}
+
+	filter.NamePrefix = query.Get("name")
+
+	if val := query.Get("status"); val != "" {
+		filter.Status = AccountStatus(val)
+		if _, ok := accountTransitions[filter.Status]; !ok {
+			return nil, validationError("invalid status")
+		}
+	}
+
+	if val := query.Get("currency"); val != "" {
+		filter.Currency = Currency(val)
+		if !filter.Currency.Valid() {
+			return nil, validationError("currency is not a supported ISO 4217 currency")
+		}
+	}
+
+	var err error
+
+	if filter.MinBalance, err = parseBalance(query.Get("min_balance")); err != nil {
+		return nil, validationError("invalid min_balance")
+	}
+
+	if filter.MaxBalance, err = parseBalance(query.Get("max_balance")); err != nil {
+		return nil, validationError("invalid max_balance")
+	}
+
+	// balances are in minor units, comparing them only makes sense within one currency
+	if filter.Currency == "" && (filter.MinBalance != nil || filter.MaxBalance != nil || filter.Sort == SortBalance) {
+		return nil, validationError("currency is required to filter or sort by balance")
+	}
+
+	if val := query.Get("cursor"); val != "" {
+		cursor, err := decodeCursor(val)
+		if err != nil || cursor.Sort != filter.Sort || cursor.Desc != filter.Desc {
+			return nil, validationError("invalid cursor")
+		}
+		filter.After = cursor
+	}
+
+	return filter, nil
+}
+
+func parseBalance(val string) (*int64, error) {
+	if val == "" {
+		return nil, nil
+	}
+
+	balance, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &balance, nil
+}
+
+// cursors are opaque to clients, they are just the JSON of AccountCursor
+func encodeCursor(cursor *AccountCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(val string) (*AccountCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(val)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor := new(AccountCursor)
+	if err := json.Unmarshal(data, cursor); err != nil {
+		return nil, err
+	}
+
+	return cursor, nil
+}
+
+// parseDate accepts RFC 3339 timestamps or plain dates, a plain end date covers the whole day
+func parseDate(val string, end bool) (time.Time, error) {
+	if val == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, val); err == nil {
+		return t.UTC(), nil
+	}
+
+	t, err := time.Parse(time.DateOnly, val)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+
+	return t, nil
 }
 
 func getID(r *http.Request) (int, error) {
@@ -251,7 +762,7 @@ func getID(r *http.Request) (int, error) {
 	id, err := strconv.Atoi(val)
 
 	if err != nil {
-		return id, fmt.Errorf("invalid id given")
+		return id, validationError("invalid id given")
 	}
 
 	return id, nil
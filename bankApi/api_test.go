@@ -0,0 +1,1501 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testSecret = "test-secret-long-enough-for-hs256"
+
+func TestMain(m *testing.M) {
+	// the default cost makes each login take a second or more under the race detector
+	passwordCost = bcrypt.MinCost
+	os.Exit(m.Run())
+}
+
+type testServer struct {
+	t     *testing.T
+	store *MemoryStore
+	rates *RateTable
+	clock *testClock
+	srv   *httptest.Server
+}
+
+// testClock stands still until the test moves it on
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	config := defaultConfig()
+	config.Store = "memory"
+	config.JWTSecret = testSecret
+	// room for slow runs, like under the race detector
+	config.RequestTimeout = time.Minute
+
+	store := NewMemoryStore()
+	rates := NewRateTable()
+	clock := &testClock{now: time.Now()}
+
+	api := newAPIServer(config, store, rates)
+	api.now = clock.Now
+	srv := httptest.NewServer(api.Handler())
+	t.Cleanup(srv.Close)
+
+	return &testServer{t: t, store: store, rates: rates, clock: clock, srv: srv}
+}
+
+// loginFailures is how many failed logins the store counts for key
+func (ts *testServer) loginFailures(key string) int {
+	ts.store.mu.Lock()
+	defer ts.store.mu.Unlock()
+
+	if attempt, ok := ts.store.logins[key]; ok {
+		return attempt.Failures
+	}
+	return 0
+}
+
+// do sends body as JSON and decodes the response into out when it is non-nil
+func (ts *testServer) do(method, path, token string, body any, out any) *http.Response {
+	ts.t.Helper()
+	return ts.doWithHeader(method, path, token, "", "", body, out)
+}
+
+// doWithHeader is do with one extra request header, skipped when key is empty
+func (ts *testServer) doWithHeader(method, path, token, key, value string, body any, out any) *http.Response {
+	ts.t.Helper()
+
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			ts.t.Fatal(err)
+		}
+	}
+
+	req, err := http.NewRequest(method, ts.srv.URL+path, &buf)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("token", token)
+	}
+	if key != "" {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// a *bytes.Buffer gets the raw body, for responses that aren't JSON
+	if raw, ok := out.(*bytes.Buffer); ok {
+		if _, err := raw.ReadFrom(resp.Body); err != nil {
+			ts.t.Fatal(err)
+		}
+	} else if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			ts.t.Fatalf("%s %s: decoding response: %v", method, path, err)
+		}
+	}
+
+	return resp
+}
+
+// createAccount signs up through the API and returns the stored account with its token
+func (ts *testServer) createAccount(first, last, password string) (*Account, string) {
+	ts.t.Helper()
+	return ts.createAccountWith(CreateAccountRequest{FirstName: first, LastName: last, Password: password})
+}
+
+func (ts *testServer) createAccountWith(req CreateAccountRequest) (*Account, string) {
+	ts.t.Helper()
+
+	var tok TokenResponse
+	resp := ts.do("POST", "/account", "", req, &tok)
+	if resp.StatusCode != http.StatusOK {
+		ts.t.Fatalf("create account: status %d", resp.StatusCode)
+	}
+
+	claims, err := validateJWT(tok.Token, []byte(testSecret))
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+
+	account, err := ts.store.GetAccountByAccNumber(context.Background(), claims.AccountNumber)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+
+	return account, tok.Token
+}
+
+func TestCreateAccountAndLogin(t *testing.T) {
+	ts := newTestServer(t)
+
+	account, _ := ts.createAccount("Ada", "Lovelace", "secret-pass")
+
+	var tok TokenResponse
+	resp := ts.do("POST", "/login", "", LoginRequest{Number: account.Number, Password: "secret-pass"}, &tok)
+	if resp.StatusCode != http.StatusOK || tok.Token == "" {
+		t.Fatalf("login: status %d, token %q", resp.StatusCode, tok.Token)
+	}
+
+	var apiErr ErrorResponse
+	resp = ts.do("POST", "/login", "", LoginRequest{Number: account.Number, Password: "wrong-pass"}, &apiErr)
+	if resp.StatusCode != http.StatusUnauthorized || apiErr.Code != CodeInvalidCredentials {
+		t.Fatalf("wrong password: status %d, code %q", resp.StatusCode, apiErr.Code)
+	}
+
+	resp = ts.do("POST", "/login", "", "{not json", &apiErr)
+	if resp.StatusCode != http.StatusBadRequest || apiErr.Code != CodeInvalidJSON {
+		t.Fatalf("bad json: status %d, code %q", resp.StatusCode, apiErr.Code)
+	}
+
+	resp = ts.do("POST", "/account", "", CreateAccountRequest{FirstName: "Short", LastName: "Pass", Password: "abc"}, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("short password: status %d", resp.StatusCode)
+	}
+}
+
+func TestGetAccount(t *testing.T) {
+	ts := newTestServer(t)
+
+	account, token := ts.createAccount("Ada", "Lovelace", "secret-pass")
+	other, _ := ts.createAccount("Alan", "Turing", "secret-pass")
+
+	var got Account
+	resp := ts.do("GET", fmt.Sprintf("/account/%d", account.ID), token, nil, &got)
+	if resp.StatusCode != http.StatusOK || got.Number != account.Number {
+		t.Fatalf("get account: status %d, number %d", resp.StatusCode, got.Number)
+	}
+
+	if resp := ts.do("GET", fmt.Sprintf("/account/%d", account.ID), "", nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("no token: status %d", resp.StatusCode)
+	}
+
+	if resp := ts.do("GET", fmt.Sprintf("/account/%d", other.ID), token, nil, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("other customer's account: status %d", resp.StatusCode)
+	}
+}
+
+// promote gives an existing account a role and returns a fresh token carrying it
+func (ts *testServer) promote(account *Account, role Role) string {
+	ts.t.Helper()
+
+	promoted, err := ts.store.UpdateAccountRole(context.Background(), account.ID, role)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+
+	token, _, err := createJWT(promoted, []byte(testSecret))
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return token
+}
+
+func TestRoles(t *testing.T) {
+	ts := newTestServer(t)
+
+	customer, customerToken := ts.createAccount("Ada", "Lovelace", "secret-pass")
+	teller, staleToken := ts.createAccount("Grace", "Hopper", "secret-pass")
+	admin, _ := ts.createAccount("Alan", "Turing", "secret-pass")
+
+	tellerToken := ts.promote(teller, RoleTeller)
+	adminToken := ts.promote(admin, RoleAdmin)
+
+	if resp := ts.do("GET", "/account", customerToken, nil, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("customer listing accounts: status %d", resp.StatusCode)
+	}
+
+	var accounts []*Account
+	if resp := ts.do("GET", "/account", adminToken, nil, &accounts); resp.StatusCode != http.StatusOK || len(accounts) != 3 {
+		t.Fatalf("admin listing accounts: status %d, %d accounts", resp.StatusCode, len(accounts))
+	}
+
+	if resp := ts.do("GET", "/account", staleToken, nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("token issued before role change: status %d", resp.StatusCode)
+	}
+
+	deposit := fmt.Sprintf("/account/%d/deposit", customer.ID)
+	if resp := ts.do("POST", deposit, tellerToken, AmountRequest{Amount: 50, Currency: "USD"}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("teller deposit: status %d", resp.StatusCode)
+	}
+
+	withdraw := fmt.Sprintf("/account/%d/withdraw", customer.ID)
+	if resp := ts.do("POST", withdraw, tellerToken, AmountRequest{Amount: 50, Currency: "USD"}, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("teller withdraw: status %d", resp.StatusCode)
+	}
+
+	role := fmt.Sprintf("/account/%d/role", customer.ID)
+	if resp := ts.do("PUT", role, tellerToken, RoleRequest{Role: RoleAdmin}, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("teller changing role: status %d", resp.StatusCode)
+	}
+
+	var updated Account
+	if resp := ts.do("PUT", role, adminToken, RoleRequest{Role: RoleTeller}, &updated); resp.StatusCode != http.StatusOK || updated.Role != RoleTeller {
+		t.Fatalf("admin changing role: status %d, role %q", resp.StatusCode, updated.Role)
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	ts := newTestServer(t)
+
+	account, token := ts.createAccount("Ada", "Lovelace", "secret-pass")
+	_, otherToken := ts.createAccount("Alan", "Turing", "secret-pass")
+	path := fmt.Sprintf("/account/%d", account.ID)
+
+	if resp := ts.do("DELETE", path, "", nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("no token: status %d", resp.StatusCode)
+	}
+
+	if resp := ts.do("DELETE", path, "not-a-jwt", nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("malformed token: status %d", resp.StatusCode)
+	}
+
+	if resp := ts.do("DELETE", path, otherToken, nil, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("other account's token: status %d", resp.StatusCode)
+	}
+
+	if resp := ts.do("DELETE", path, token, nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("own token: status %d", resp.StatusCode)
+	}
+
+	closed, err := ts.store.GetAccountByID(context.Background(), account.ID)
+	if err != nil {
+		t.Fatalf("closed account should be kept: %v", err)
+	}
+	if closed.Status != StatusClosed {
+		t.Fatalf("status %q, want %q", closed.Status, StatusClosed)
+	}
+
+	login := LoginRequest{Number: account.Number, Password: "secret-pass"}
+	if resp := ts.do("POST", "/login", "", login, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("login to closed account: status %d", resp.StatusCode)
+	}
+
+	if resp := ts.do("GET", path, token, nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("token of closed account: status %d", resp.StatusCode)
+	}
+}
+
+func TestAccountStatus(t *testing.T) {
+	ts := newTestServer(t)
+
+	alice, aliceToken := ts.createAccount("Alice", "A", "secret-pass")
+	bob, _ := ts.createAccount("Bob", "B", "secret-pass")
+	admin, _ := ts.createAccount("Root", "Admin", "secret-pass")
+	adminToken := ts.promote(admin, RoleAdmin)
+	path := fmt.Sprintf("/account/%d", alice.ID)
+	reason := StatusChangeRequest{Reason: "lost card"}
+
+	if _, err := ts.store.Deposit(context.Background(), alice.ID, NewMoney(50, "USD")); err != nil {
+		t.Fatal(err)
+	}
+
+	var errResp ErrorResponse
+	if resp := ts.do("POST", path+"/close", aliceToken, reason, &errResp); resp.StatusCode != http.StatusConflict || errResp.Code != CodeBalanceNotZero {
+		t.Fatalf("closing with balance: status %d, code %q", resp.StatusCode, errResp.Code)
+	}
+
+	if resp := ts.do("POST", path+"/freeze", aliceToken, reason, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("freeze: status %d", resp.StatusCode)
+	}
+
+	transfer := TransferRequest{ToAccount: bob.Number, Amount: 10, Currency: "USD"}
+	if resp := ts.do("POST", "/transfer", aliceToken, transfer, &errResp); resp.StatusCode != http.StatusUnprocessableEntity || errResp.Code != CodeAccountNotActive {
+		t.Fatalf("transfer from frozen account: status %d, code %q", resp.StatusCode, errResp.Code)
+	}
+
+	if resp := ts.do("POST", path+"/reopen", aliceToken, reason, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("owner reopening: status %d", resp.StatusCode)
+	}
+
+	var reopened Account
+	if resp := ts.do("POST", path+"/reopen", adminToken, reason, &reopened); resp.StatusCode != http.StatusOK || reopened.Status != StatusActive {
+		t.Fatalf("admin reopening: status %d, account status %q", resp.StatusCode, reopened.Status)
+	}
+
+	if resp := ts.do("POST", "/transfer", aliceToken, transfer, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("transfer after reopen: status %d", resp.StatusCode)
+	}
+}
+
+func TestListAccounts(t *testing.T) {
+	ts := newTestServer(t)
+
+	admin, _ := ts.createAccount("Root", "Admin", "secret-pass")
+	adminToken := ts.promote(admin, RoleAdmin)
+
+	for i, name := range []string{"Ann", "Anna", "Bea", "Cid"} {
+		account, _ := ts.createAccount(name, "Smith", "secret-pass")
+		if _, err := ts.store.Deposit(context.Background(), account.ID, NewMoney(int64(10*(i+1)), "USD")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ts.createAccountWith(CreateAccountRequest{FirstName: "Yui", LastName: "Sato", Password: "secret-pass", Currency: "JPY"})
+
+	var balances []int64
+	path := "/account?sort=balance&order=desc&limit=2&currency=USD"
+	for path != "" {
+		var page []*Account
+		resp := ts.do("GET", path, adminToken, nil, &page)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Total-Count") != "5" {
+			t.Fatalf("GET %s: status %d, total %q", path, resp.StatusCode, resp.Header.Get("X-Total-Count"))
+		}
+		for _, account := range page {
+			balances = append(balances, account.Balance.Amount)
+		}
+
+		path = ""
+		if link := resp.Header.Get("Link"); link != "" {
+			path = strings.TrimPrefix(strings.Split(link, ">")[0], "<")
+		}
+	}
+
+	if fmt.Sprint(balances) != "[40 30 20 10 0]" {
+		t.Fatalf("balances %v, want descending", balances)
+	}
+
+	var filtered []*Account
+	resp := ts.do("GET", "/account?name=an&min_balance=15&currency=USD", adminToken, nil, &filtered)
+	if resp.StatusCode != http.StatusOK || len(filtered) != 1 || filtered[0].FirstName != "Anna" {
+		t.Fatalf("filtered: status %d, accounts %v", resp.StatusCode, filtered)
+	}
+
+	if resp := ts.do("GET", "/account?sort=balance&currency=USD&cursor=bogus", adminToken, nil, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bad cursor: status %d", resp.StatusCode)
+	}
+
+	// yen and cents can't be compared
+	for _, path := range []string{"/account?sort=balance", "/account?min_balance=15", "/account?max_balance=15"} {
+		if resp := ts.do("GET", path, adminToken, nil, nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("GET %s without currency: status %d", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	ts := newTestServer(t)
+
+	alice, aliceToken := ts.createAccount("Alice", "A", "secret-pass")
+	bob, _ := ts.createAccount("Bob", "B", "secret-pass")
+
+	if _, err := ts.store.Deposit(context.Background(), alice.ID, NewMoney(100, "USD")); err != nil {
+		t.Fatal(err)
+	}
+
+	var got Account
+	resp := ts.do("POST", "/transfer", aliceToken, TransferRequest{ToAccount: bob.Number, Amount: 40, Currency: "USD"}, &got)
+	if resp.StatusCode != http.StatusOK || got.Balance.Amount != 60 {
+		t.Fatalf("transfer: status %d, balance %d", resp.StatusCode, got.Balance.Amount)
+	}
+
+	if b, _ := ts.store.GetAccountByID(context.Background(), bob.ID); b.Balance.Amount != 40 {
+		t.Fatalf("recipient balance %d, want 40", b.Balance.Amount)
+	}
+
+	rejected := []struct {
+		name   string
+		req    TransferRequest
+		status int
+		code   string
+	}{
+		{"insufficient funds", TransferRequest{ToAccount: bob.Number, Amount: 1000, Currency: "USD"}, http.StatusUnprocessableEntity, CodeInsufficientFunds},
+		{"self transfer", TransferRequest{ToAccount: alice.Number, Amount: 10, Currency: "USD"}, http.StatusUnprocessableEntity, CodeSelfTransfer},
+		{"non-positive amount", TransferRequest{ToAccount: bob.Number, Amount: 0, Currency: "USD"}, http.StatusBadRequest, CodeValidation},
+		{"unknown recipient", TransferRequest{ToAccount: 1234567897, Amount: 10, Currency: "USD"}, http.StatusNotFound, CodeAccountNotFound},
+		{"bad check digit", TransferRequest{ToAccount: bob.Number ^ 1, Amount: 10, Currency: "USD"}, http.StatusBadRequest, CodeValidation},
+	}
+
+	for _, tc := range rejected {
+		var apiErr ErrorResponse
+		resp := ts.do("POST", "/transfer", aliceToken, tc.req, &apiErr)
+		if resp.StatusCode != tc.status || apiErr.Code != tc.code {
+			t.Errorf("%s: status %d, code %q", tc.name, resp.StatusCode, apiErr.Code)
+		}
+	}
+
+	if resp := ts.do("POST", "/transfer", "", TransferRequest{ToAccount: bob.Number, Amount: 10, Currency: "USD"}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("no token: status %d", resp.StatusCode)
+	}
+
+	if a, _ := ts.store.GetAccountByID(context.Background(), alice.ID); a.Balance.Amount != 60 {
+		t.Fatalf("sender balance %d after rejected transfers, want 60", a.Balance.Amount)
+	}
+}
+
+func TestBalanceOverflow(t *testing.T) {
+	ts := newTestServer(t)
+
+	alice, aliceToken := ts.createAccount("Alice", "A", "secret-pass")
+	bob, _ := ts.createAccount("Bob", "B", "secret-pass")
+
+	if _, err := ts.store.Deposit(context.Background(), alice.ID, NewMoney(100, "USD")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.store.Deposit(context.Background(), bob.ID, NewMoney(math.MaxInt64, "USD")); err != nil {
+		t.Fatal(err)
+	}
+
+	// a second deposit and the credit side of a transfer would both wrap bob's balance
+	if _, err := ts.store.Deposit(context.Background(), bob.ID, NewMoney(math.MaxInt64, "USD")); !errors.Is(err, ErrInvalidAmount) {
+		t.Fatalf("deposit past the largest balance: %v", err)
+	}
+
+	var apiErr ErrorResponse
+	resp := ts.do("POST", "/transfer", aliceToken, TransferRequest{ToAccount: bob.Number, Amount: 40, Currency: "USD"}, &apiErr)
+	if resp.StatusCode != http.StatusBadRequest || apiErr.Code != CodeInvalidAmount {
+		t.Fatalf("transfer past the largest balance: status %d, code %q", resp.StatusCode, apiErr.Code)
+	}
+
+	a, _ := ts.store.GetAccountByID(context.Background(), alice.ID)
+	b, _ := ts.store.GetAccountByID(context.Background(), bob.ID)
+	if a.Balance.Amount != 100 || b.Balance.Amount != math.MaxInt64 {
+		t.Fatalf("balances after rejected overflows: %d and %d", a.Balance.Amount, b.Balance.Amount)
+	}
+}
+
+func TestCrossCurrencyTransfer(t *testing.T) {
+	ts := newTestServer(t)
+
+	alice, aliceToken := ts.createAccount("Alice", "A", "secret-pass")
+	bob, _ := ts.createAccountWith(CreateAccountRequest{FirstName: "Bob", LastName: "B", Password: "secret-pass", Currency: "JPY"})
+	admin, _ := ts.createAccount("Root", "Admin", "secret-pass")
+	adminToken := ts.promote(admin, RoleAdmin)
+
+	if _, err := ts.store.Deposit(context.Background(), alice.ID, NewMoney(1000, "USD")); err != nil {
+		t.Fatal(err)
+	}
+
+	var errResp ErrorResponse
+	deposit := fmt.Sprintf("/account/%d/deposit", alice.ID)
+	if resp := ts.do("POST", deposit, aliceToken, AmountRequest{Amount: 10, Currency: "EUR"}, &errResp); resp.StatusCode != http.StatusUnprocessableEntity || errResp.Code != CodeCurrencyMismatch {
+		t.Fatalf("deposit in another currency: status %d, code %q", resp.StatusCode, errResp.Code)
+	}
+
+	transfer := TransferRequest{ToAccount: bob.Number, Amount: 250, Currency: "USD"}
+	if resp := ts.do("POST", "/transfer", aliceToken, transfer, &errResp); resp.StatusCode != http.StatusUnprocessableEntity || errResp.Code != CodeNoExchangeRate {
+		t.Fatalf("transfer without a rate: status %d, code %q", resp.StatusCode, errResp.Code)
+	}
+
+	rates := RatesRequest{Rates: []ExchangeRate{{From: "USD", To: "JPY", Rate: "151.37"}}}
+	if resp := ts.do("PUT", "/rates", aliceToken, rates, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("customer setting rates: status %d", resp.StatusCode)
+	}
+	if resp := ts.do("PUT", "/rates", adminToken, rates, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("admin setting rates: status %d", resp.StatusCode)
+	}
+
+	if resp := ts.do("POST", "/transfer", aliceToken, transfer, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("transfer: status %d", resp.StatusCode)
+	}
+
+	// 2.50 USD at 151.37 is 378.425 JPY, rounded to 378
+	if b, _ := ts.store.GetAccountByID(context.Background(), bob.ID); b.Balance != NewMoney(378, "JPY") {
+		t.Fatalf("recipient balance %v, want 378 JPY", b.Balance)
+	}
+
+	var history []*Transaction
+	ts.do("GET", fmt.Sprintf("/account/%d/transactions", alice.ID), aliceToken, nil, &history)
+	last := history[len(history)-1]
+	if last.Amount != NewMoney(250, "USD") || last.Credited == nil || *last.Credited != NewMoney(378, "JPY") || last.Rate != "151.37" {
+		t.Fatalf("ledger entry %+v", last)
+	}
+}
+
+func TestIdempotentTransfer(t *testing.T) {
+	ts := newTestServer(t)
+
+	alice, aliceToken := ts.createAccount("Alice", "A", "secret-pass")
+	bob, _ := ts.createAccount("Bob", "B", "secret-pass")
+
+	if _, err := ts.store.Deposit(context.Background(), alice.ID, NewMoney(100, "USD")); err != nil {
+		t.Fatal(err)
+	}
+
+	req := TransferRequest{ToAccount: bob.Number, Amount: 40, Currency: "USD"}
+
+	var first, second Account
+	ts.doWithHeader("POST", "/transfer", aliceToken, idempotencyHeader, "key-1", req, &first)
+	resp := ts.doWithHeader("POST", "/transfer", aliceToken, idempotencyHeader, "key-1", req, &second)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Idempotent-Replayed") != "true" || second.Balance != first.Balance {
+		t.Fatalf("retry: status %d, replayed %q, balance %v after %v", resp.StatusCode, resp.Header.Get("Idempotent-Replayed"), second.Balance, first.Balance)
+	}
+
+	if b, _ := ts.store.GetAccountByID(context.Background(), bob.ID); b.Balance.Amount != 40 {
+		t.Fatalf("recipient balance %d after a retried transfer, want 40", b.Balance.Amount)
+	}
+
+	var apiErr ErrorResponse
+	resp = ts.doWithHeader("POST", "/transfer", aliceToken, idempotencyHeader, "key-1", TransferRequest{ToAccount: bob.Number, Amount: 41, Currency: "USD"}, &apiErr)
+	if resp.StatusCode != http.StatusUnprocessableEntity || apiErr.Code != CodeIdempotencyMismatch {
+		t.Fatalf("same key, other body: status %d, code %q", resp.StatusCode, apiErr.Code)
+	}
+
+	// a key whose first request is still running
+	var body bytes.Buffer
+	json.NewEncoder(&body).Encode(req)
+	pending := &IdempotencyRecord{
+		Key:         fmt.Sprintf("%d:%s", alice.Number, "key-2"),
+		RequestHash: hashRequest(httptest.NewRequest("POST", "/transfer", nil), body.Bytes()),
+		CreatedAt:   time.Now().UTC(),
+	}
+	if err := ts.store.CreateIdempotencyRecord(context.Background(), pending); err != nil {
+		t.Fatal(err)
+	}
+
+	resp = ts.doWithHeader("POST", "/transfer", aliceToken, idempotencyHeader, "key-2", req, &apiErr)
+	if resp.StatusCode != http.StatusConflict || apiErr.Code != CodeIdempotencyPending {
+		t.Fatalf("key in progress: status %d, code %q", resp.StatusCode, apiErr.Code)
+	}
+}
+
+func TestIdempotencyReleasesFailedRequests(t *testing.T) {
+	store := NewMemoryStore()
+	caller := &Account{Number: 1234567897}
+
+	for _, tc := range []struct {
+		status int
+		kept   bool
+	}{
+		{http.StatusOK, true},
+		{http.StatusUnprocessableEntity, true},
+		{http.StatusInternalServerError, false},
+		{http.StatusGatewayTimeout, false},
+		{statusClientClosedRequest, false},
+	} {
+		key := fmt.Sprintf("key-%d", tc.status)
+		handler := withIdempotency(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.status)
+		}, store)
+
+		req := httptest.NewRequest("POST", "/transfer", strings.NewReader("{}"))
+		req.Header.Set(idempotencyHeader, key)
+		handler(httptest.NewRecorder(), req.WithContext(context.WithValue(req.Context(), callerKey, caller)))
+
+		_, err := store.GetIdempotencyRecord(context.Background(), fmt.Sprintf("%d:%s", caller.Number, key))
+		if kept := err == nil; kept != tc.kept {
+			t.Errorf("status %d: record kept %v, want %v", tc.status, kept, tc.kept)
+		}
+	}
+}
+
+func TestScheduledTransfer(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+
+	alice, aliceToken := ts.createAccount("Alice", "A", "secret-pass")
+	bob, bobToken := ts.createAccount("Bob", "B", "secret-pass")
+
+	start := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	req := ScheduleRequest{
+		TransferRequest: TransferRequest{ToAccount: bob.Number, Amount: 30, Currency: "USD"},
+		StartAt:         start,
+		Frequency:       FrequencyMonthly,
+	}
+
+	var schedule TransferSchedule
+	if resp := ts.do("POST", "/transfer/schedules", aliceToken, req, &schedule); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create schedule: status %d", resp.StatusCode)
+	}
+	path := fmt.Sprintf("/transfer/schedules/%d", schedule.ID)
+
+	if resp := ts.do("GET", path, bobToken, nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("someone else's schedule: status %d", resp.StatusCode)
+	}
+
+	// nothing to send yet, then a failed attempt that is retried later
+	if run, err := ts.store.RunSchedule(ctx, schedule.ID, time.Now(), ts.rates); err != nil || run != nil {
+		t.Fatalf("run before start: %v, %v", run, err)
+	}
+
+	run, err := ts.store.RunSchedule(ctx, schedule.ID, start, ts.rates)
+	if err != nil || run.Status != RunFailed {
+		t.Fatalf("run without funds: %+v, %v", run, err)
+	}
+
+	if _, err := ts.store.Deposit(ctx, alice.ID, NewMoney(100, "USD")); err != nil {
+		t.Fatal(err)
+	}
+
+	if run, _ := ts.store.RunSchedule(ctx, schedule.ID, start, ts.rates); run != nil {
+		t.Fatalf("retried before the backoff: %+v", run)
+	}
+
+	retryAt := start.Add(scheduleRetryDelay)
+	if run, err := ts.store.RunSchedule(ctx, schedule.ID, retryAt, ts.rates); err != nil || run.Status != RunCompleted {
+		t.Fatalf("retry: %+v, %v", run, err)
+	}
+
+	// the same occurrence is never sent twice
+	if run, _ := ts.store.RunSchedule(ctx, schedule.ID, retryAt, ts.rates); run != nil {
+		t.Fatalf("second run of one occurrence: %+v", run)
+	}
+
+	if b, _ := ts.store.GetAccountByID(ctx, bob.ID); b.Balance.Amount != 30 {
+		t.Fatalf("recipient balance %d, want 30", b.Balance.Amount)
+	}
+
+	ts.do("GET", path, aliceToken, nil, &schedule)
+	if !schedule.RunAt.Equal(start.AddDate(0, 1, 0)) || schedule.Attempts != 0 || schedule.Runs != 1 {
+		t.Fatalf("schedule after run: %+v", schedule)
+	}
+
+	var runs []*ScheduleRun
+	if ts.do("GET", path+"/runs", aliceToken, nil, &runs); len(runs) != 2 || runs[0].Error == "" {
+		t.Fatalf("runs %+v", runs)
+	}
+
+	if resp := ts.do("POST", path+"/pause", aliceToken, nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("pause: status %d", resp.StatusCode)
+	}
+	if run, _ := ts.store.RunSchedule(ctx, schedule.ID, schedule.RunAt, ts.rates); run != nil {
+		t.Fatalf("paused schedule ran: %+v", run)
+	}
+
+	if resp := ts.do("POST", path+"/cancel", aliceToken, nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("cancel: status %d", resp.StatusCode)
+	}
+	if resp := ts.do("POST", path+"/resume", aliceToken, nil, nil); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("resuming a cancelled schedule: status %d", resp.StatusCode)
+	}
+}
+
+func TestScheduleEndAtInUTC(t *testing.T) {
+	ts := newTestServer(t)
+
+	_, aliceToken := ts.createAccount("Alice", "A", "secret-pass")
+	bob, _ := ts.createAccount("Bob", "B", "secret-pass")
+
+	start := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	end := start.Add(30 * 24 * time.Hour).In(time.FixedZone("UTC+5", 5*60*60))
+	req := ScheduleRequest{
+		TransferRequest: TransferRequest{ToAccount: bob.Number, Amount: 30, Currency: "USD"},
+		StartAt:         start,
+		Frequency:       FrequencyDaily,
+		EndAt:           &end,
+	}
+
+	var schedule TransferSchedule
+	if resp := ts.do("POST", "/transfer/schedules", aliceToken, req, &schedule); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create schedule: status %d", resp.StatusCode)
+	}
+
+	stored, err := ts.store.GetSchedule(context.Background(), schedule.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.EndAt == nil || stored.EndAt.Location() != time.UTC || !stored.EndAt.Equal(end) {
+		t.Fatalf("end stored as %v, want %v", stored.EndAt, end.UTC())
+	}
+}
+
+func TestResumeSkipsMissedOccurrences(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+
+	alice, aliceToken := ts.createAccount("Alice", "A", "secret-pass")
+	bob, _ := ts.createAccount("Bob", "B", "secret-pass")
+
+	if _, err := ts.store.Deposit(ctx, alice.ID, NewMoney(1000, "USD")); err != nil {
+		t.Fatal(err)
+	}
+
+	req := ScheduleRequest{
+		TransferRequest: TransferRequest{ToAccount: bob.Number, Amount: 10, Currency: "USD"},
+		StartAt:         time.Now().UTC().Add(time.Hour),
+		Frequency:       FrequencyDaily,
+	}
+
+	var schedule TransferSchedule
+	ts.do("POST", "/transfer/schedules", aliceToken, req, &schedule)
+	path := fmt.Sprintf("/transfer/schedules/%d", schedule.ID)
+
+	if resp := ts.do("POST", path+"/pause", aliceToken, nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("pause: status %d", resp.StatusCode)
+	}
+
+	// the pause outlasted three daily occurrences
+	now := time.Now().UTC()
+	start := now.Add(-72*time.Hour + time.Minute).Truncate(time.Second)
+	stored := ts.store.schedules[schedule.ID]
+	stored.StartAt, stored.RunAt, stored.NextAttemptAt = start, start, start
+
+	if resp := ts.do("POST", path+"/resume", aliceToken, nil, &schedule); resp.StatusCode != http.StatusOK {
+		t.Fatalf("resume: status %d", resp.StatusCode)
+	}
+
+	if !schedule.RunAt.Equal(start.AddDate(0, 0, 3)) || !schedule.NextAttemptAt.Equal(schedule.RunAt) || schedule.Skipped != 3 || schedule.Runs != 0 {
+		t.Fatalf("schedule after resume: %+v", schedule)
+	}
+
+	if ids, _ := ts.store.GetDueSchedules(ctx, time.Now().UTC(), scheduleBatchSize); len(ids) != 0 {
+		t.Fatalf("missed occurrences still due: %v", ids)
+	}
+
+	// the next occurrence goes out as usual and the one after follows the original rhythm
+	if run, err := ts.store.RunSchedule(ctx, schedule.ID, schedule.RunAt, ts.rates); err != nil || run.Status != RunCompleted {
+		t.Fatalf("run after resume: %+v, %v", run, err)
+	}
+
+	ts.do("GET", path, aliceToken, nil, &schedule)
+	if !schedule.RunAt.Equal(start.AddDate(0, 0, 4)) || schedule.Runs != 1 {
+		t.Fatalf("schedule after the first run: %+v", schedule)
+	}
+
+	if b, _ := ts.store.GetAccountByID(ctx, bob.ID); b.Balance.Amount != 10 {
+		t.Fatalf("recipient balance %d, want one transfer of 10", b.Balance.Amount)
+	}
+}
+
+func TestMonthlyOccurrenceClampsToMonthEnd(t *testing.T) {
+	start := time.Date(2024, time.January, 31, 9, 0, 0, 0, time.UTC)
+
+	for n, want := range []string{"2024-01-31", "2024-02-29", "2024-03-31", "2024-04-30"} {
+		if got := occurrence(start, FrequencyMonthly, n).Format(time.DateOnly); got != want {
+			t.Errorf("occurrence %d: %s, want %s", n, got, want)
+		}
+	}
+}
+
+func TestStatement(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+
+	alice, aliceToken := ts.createAccount("Alice", "A", "secret-pass")
+	bob, _ := ts.createAccount("Bob", "B", "secret-pass")
+
+	if _, err := ts.store.Deposit(ctx, alice.ID, NewMoney(100, "USD")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.store.Transfer(ctx, alice.Number, &TransferRequest{ToAccount: bob.Number, Amount: 30, Currency: "USD"}, ts.rates); err != nil {
+		t.Fatal(err)
+	}
+
+	today := time.Now().UTC().Format(time.DateOnly)
+	path := fmt.Sprintf("/account/%d/statement?from=%s&to=%s", alice.ID, today, today)
+
+	var csvBody bytes.Buffer
+	resp := ts.do("GET", path, aliceToken, nil, &csvBody)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/csv; charset=utf-8" {
+		t.Fatalf("csv: status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	rows, err := csv.NewReader(&csvBody).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 5 || rows[1][1] != "opening_balance" || rows[1][7] != "0.00" || rows[3][4] != "-0.30" || rows[4][1] != "closing_balance" || rows[4][7] != "0.70" {
+		t.Fatalf("csv rows %q", rows)
+	}
+
+	var statement struct {
+		OpeningBalance Money          `json:"openingBalance"`
+		Transactions   []*Transaction `json:"transactions"`
+		ClosingBalance Money          `json:"closingBalance"`
+	}
+	ts.do("GET", path+"&format=json", aliceToken, nil, &statement)
+	if statement.OpeningBalance.Amount != 0 || len(statement.Transactions) != 2 || statement.ClosingBalance.Amount != 70 {
+		t.Fatalf("json statement %+v", statement)
+	}
+
+	var ofx bytes.Buffer
+	ts.do("GET", path+"&format=ofx", aliceToken, nil, &ofx)
+	if !strings.Contains(ofx.String(), "<TRNAMT>-0.30</TRNAMT>") || !strings.Contains(ofx.String(), "<BALAMT>0.70</BALAMT>") {
+		t.Fatalf("ofx statement:\n%s", ofx.String())
+	}
+
+	// a period after all the activity opens and closes on the current balance
+	tomorrow := time.Now().UTC().AddDate(0, 0, 1).Format(time.DateOnly)
+	ts.do("GET", fmt.Sprintf("/account/%d/statement?from=%s&format=json&to=%s", alice.ID, tomorrow, tomorrow), aliceToken, nil, &statement)
+	if statement.OpeningBalance.Amount != 70 || len(statement.Transactions) != 0 || statement.ClosingBalance.Amount != 70 {
+		t.Fatalf("later statement %+v", statement)
+	}
+
+	if resp := ts.do("GET", path+"&format=pdf", aliceToken, nil, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unknown format: status %d", resp.StatusCode)
+	}
+}
+
+// brokenStatementStore fails a statement after its first line, and remembers the deadline it got
+type brokenStatementStore struct {
+	*MemoryStore
+	deadline time.Time
+}
+
+func (s *brokenStatementStore) GetStatement(ctx context.Context, id int, from, to time.Time, w StatementWriter) error {
+	s.deadline, _ = ctx.Deadline()
+
+	account, err := s.GetAccountByID(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if err := w.Begin(&Statement{Account: account, From: from, To: to, Opening: account.Balance}); err != nil {
+		return err
+	}
+	return fmt.Errorf("connection lost")
+}
+
+func TestTruncatedStatementIsDetectable(t *testing.T) {
+	config := defaultConfig()
+	config.Store = "memory"
+	config.JWTSecret = testSecret
+
+	store := &brokenStatementStore{MemoryStore: NewMemoryStore()}
+	srv := httptest.NewServer(newAPIServer(config, store, NewRateTable()).Handler())
+	t.Cleanup(srv.Close)
+
+	ts := &testServer{t: t, store: store.MemoryStore, rates: NewRateTable(), srv: srv}
+	account, token := ts.createAccount("Ada", "Lovelace", "secret-pass")
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("%s/account/%d/statement?from=2024-01-01&format=json", srv.URL, account.ID), nil)
+	req.Header.Set("token", token)
+
+	started := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	// the opening of the JSON statement is already out, the connection has to be cut
+	if err == nil {
+		t.Fatal("truncated statement was delivered as a complete response")
+	}
+
+	if store.deadline.Sub(started) <= config.RequestTimeout {
+		t.Fatalf("statement ran under the request timeout, deadline %v", store.deadline.Sub(started))
+	}
+}
+
+// slowStatementStore holds every statement open until release is closed, like a client
+// reading slowly would
+type slowStatementStore struct {
+	*MemoryStore
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *slowStatementStore) GetStatement(ctx context.Context, id int, from, to time.Time, w StatementWriter) error {
+	s.started <- struct{}{}
+	<-s.release
+	return s.MemoryStore.GetStatement(ctx, id, from, to, w)
+}
+
+func TestConcurrentStatementsAreCapped(t *testing.T) {
+	config := defaultConfig()
+	config.Store = "memory"
+	config.JWTSecret = testSecret
+	config.MaxStatements = 1
+
+	store := &slowStatementStore{MemoryStore: NewMemoryStore(), started: make(chan struct{}, 1), release: make(chan struct{})}
+	srv := httptest.NewServer(newAPIServer(config, store, NewRateTable()).Handler())
+	t.Cleanup(srv.Close)
+
+	ts := &testServer{t: t, store: store.MemoryStore, rates: NewRateTable(), srv: srv}
+	account, token := ts.createAccount("Ada", "Lovelace", "secret-pass")
+	path := fmt.Sprintf("/account/%d/statement?from=2024-01-01", account.ID)
+
+	first := make(chan int)
+	go func() {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		req.Header.Set("token", token)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			first <- 0
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		first <- resp.StatusCode
+	}()
+	<-store.started
+
+	var apiErr ErrorResponse
+	resp := ts.do("GET", path, token, nil, &apiErr)
+	if resp.StatusCode != http.StatusServiceUnavailable || apiErr.Code != CodeTooManyStatements || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("statement while another streams: status %d, code %q", resp.StatusCode, apiErr.Code)
+	}
+
+	close(store.release)
+	if status := <-first; status != http.StatusOK {
+		t.Fatalf("first statement: status %d", status)
+	}
+
+	// the slot is free again once the first one is done
+	if resp := ts.do("GET", path, token, nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("statement after the first finished: status %d", resp.StatusCode)
+	}
+}
+
+func TestLoginBackoff(t *testing.T) {
+	ts := newTestServer(t)
+
+	account, _ := ts.createAccount("Ada", "Lovelace", "secret-pass")
+
+	// an unknown number fails exactly like a wrong password
+	var unknown, wrong ErrorResponse
+	ts.do("POST", "/login", "", LoginRequest{Number: 1234567897, Password: "secret-pass"}, &unknown)
+	ts.do("POST", "/login", "", LoginRequest{Number: account.Number, Password: "wrong-pass"}, &wrong)
+	if unknown.Code != wrong.Code || unknown.Error != wrong.Error || wrong.Code != CodeInvalidCredentials {
+		t.Fatalf("unknown account %+v, wrong password %+v", unknown, wrong)
+	}
+
+	for i := 1; i < accountLoginPolicy.free+1; i++ {
+		ts.do("POST", "/login", "", LoginRequest{Number: account.Number, Password: "wrong-pass"}, nil)
+	}
+
+	var apiErr ErrorResponse
+	resp := ts.do("POST", "/login", "", LoginRequest{Number: account.Number, Password: "secret-pass"}, &apiErr)
+	if resp.StatusCode != http.StatusTooManyRequests || apiErr.Code != CodeTooManyAttempts || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("login while backing off: status %d, code %q, Retry-After %q", resp.StatusCode, apiErr.Code, resp.Header.Get("Retry-After"))
+	}
+
+	// once the wait is over the right password works and clears the account's failures
+	ts.clock.Advance(time.Minute)
+	key := loginKeys(&http.Request{RemoteAddr: "127.0.0.1:1"}, account.Number)[0].key
+
+	if resp := ts.do("POST", "/login", "", LoginRequest{Number: account.Number, Password: "secret-pass"}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("login after backoff: status %d", resp.StatusCode)
+	}
+	if failures := ts.loginFailures(key); failures != 0 {
+		t.Fatalf("failures after success: %d", failures)
+	}
+}
+
+func TestRightPasswordKeepsTheIPWait(t *testing.T) {
+	ts := newTestServer(t)
+
+	account, _ := ts.createAccount("Ada", "Lovelace", "secret-pass")
+
+	// unknown numbers, so only the shared IP runs into its backoff
+	for i := int64(0); i <= int64(ipLoginPolicy.free); i++ {
+		payload := 123456780 + i
+		ts.do("POST", "/login", "", LoginRequest{Number: payload*10 + luhnCheckDigit(payload), Password: "wrong-pass"}, nil)
+	}
+
+	// the one second wait is over, a customer behind the same IP logs in
+	ts.clock.Advance(2 * time.Second)
+	if resp := ts.do("POST", "/login", "", LoginRequest{Number: account.Number, Password: "secret-pass"}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("login after the wait: status %d", resp.StatusCode)
+	}
+
+	// the success neither counts nor starts the wait over for the next one on the IP
+	if resp := ts.do("POST", "/login", "", LoginRequest{Number: account.Number, Password: "wrong-pass"}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("login after a success from the same IP: status %d", resp.StatusCode)
+	}
+}
+
+func TestConcurrentLoginsShareTheBackoff(t *testing.T) {
+	ts := newTestServer(t)
+
+	account, _ := ts.createAccount("Ada", "Lovelace", "secret-pass")
+
+	statuses := make(chan int, 20)
+	for i := 0; i < cap(statuses); i++ {
+		go func() {
+			body, _ := json.Marshal(LoginRequest{Number: account.Number, Password: "wrong-pass"})
+			resp, err := http.Post(ts.srv.URL+"/login", "application/json", bytes.NewReader(body))
+			if err != nil {
+				statuses <- 0
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+
+	guesses := 0
+	for i := 0; i < cap(statuses); i++ {
+		switch status := <-statuses; status {
+		case http.StatusUnauthorized:
+			guesses++
+		case http.StatusTooManyRequests:
+		default:
+			t.Errorf("unexpected status %d", status)
+		}
+	}
+
+	// the free failures plus the one that starts the backoff, however many race in
+	if guesses != accountLoginPolicy.free+1 {
+		t.Fatalf("%d passwords checked, want %d", guesses, accountLoginPolicy.free+1)
+	}
+}
+
+func TestLoginPolicy(t *testing.T) {
+	last := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		policy loginPolicy
+		waits  map[int]time.Duration
+	}{
+		{"account", accountLoginPolicy, map[int]time.Duration{0: 0, 3: 0, 4: time.Second, 6: 4 * time.Second, 10: 15 * time.Minute, 50: 15 * time.Minute}},
+		// the doubling runs far enough for the shift to overflow before the lockout
+		{"ip", ipLoginPolicy, map[int]time.Duration{20: 0, 21: time.Second, 30: 512 * time.Second, 31: 15 * time.Minute, 56: 15 * time.Minute, 59: 15 * time.Minute, 65: 15 * time.Minute, 77: 15 * time.Minute, 99: 15 * time.Minute, 100: 15 * time.Minute}},
+	}
+
+	for _, tt := range tests {
+		for failures, want := range tt.waits {
+			until := tt.policy.blockedUntil(&LoginAttempt{Failures: failures, LastFailureAt: last})
+			if got := until.Sub(last); (want == 0 && !until.IsZero()) || (want != 0 && got != want) {
+				t.Errorf("%s, %d failures: blocked until %v, want %v after the last one", tt.name, failures, until, want)
+			}
+		}
+	}
+}
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, SHA1, cut down to 6 digits
+	key := []byte("12345678901234567890")
+	for unix, want := range map[int64]string{59: "287082", 1111111109: "081804", 1234567890: "005924"} {
+		if got := totpCode(key, unix/totpPeriod); got != want {
+			t.Errorf("at %d: code %s, want %s", unix, got, want)
+		}
+	}
+
+	secret := base32NoPadding.EncodeToString(key)
+	if counter, ok := matchTOTP(secret, "287082", time.Unix(59+totpPeriod, 0)); !ok || counter != 1 {
+		t.Fatalf("code from the previous step: counter %d, ok %v", counter, ok)
+	}
+	if _, ok := matchTOTP(secret, "287082", time.Unix(59+3*totpPeriod, 0)); ok {
+		t.Fatal("code from three steps ago was accepted")
+	}
+}
+
+// enableTwoFactor enrolls and confirms account, returning its secret, the time step used
+// for the confirmation and the recovery codes
+func (ts *testServer) enableTwoFactor(account *Account, token string) (string, int64, []string) {
+	ts.t.Helper()
+
+	path := fmt.Sprintf("/account/%d/2fa", account.ID)
+
+	var enrollment EnrollmentResponse
+	if resp := ts.do("POST", path, token, nil, &enrollment); resp.StatusCode != http.StatusCreated {
+		ts.t.Fatalf("enroll: status %d", resp.StatusCode)
+	}
+
+	counter := time.Now().Unix() / totpPeriod
+
+	var recovery RecoveryCodesResponse
+	if resp := ts.do("POST", path+"/confirm", token, OTPRequest{Code: totpAt(enrollment.Secret, counter)}, &recovery); resp.StatusCode != http.StatusOK {
+		ts.t.Fatalf("confirm: status %d", resp.StatusCode)
+	}
+
+	return enrollment.Secret, counter, recovery.RecoveryCodes
+}
+
+func totpAt(secret string, counter int64) string {
+	key, _ := base32NoPadding.DecodeString(secret)
+	return totpCode(key, counter)
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	ts := newTestServer(t)
+
+	account, token := ts.createAccount("Ada", "Lovelace", "secret-pass")
+	login := LoginRequest{Number: account.Number, Password: "secret-pass"}
+
+	var enrollment EnrollmentResponse
+	ts.do("POST", fmt.Sprintf("/account/%d/2fa", account.ID), token, nil, &enrollment)
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/BankAPI:") || !strings.Contains(enrollment.URI, "secret="+enrollment.Secret) {
+		t.Fatalf("otpauth uri %q", enrollment.URI)
+	}
+
+	// an unconfirmed enrollment changes nothing
+	var tok TokenResponse
+	if ts.do("POST", "/login", "", login, &tok); tok.Token == "" {
+		t.Fatal("login with unconfirmed two-factor did not issue tokens")
+	}
+
+	var apiErr ErrorResponse
+	resp := ts.do("POST", fmt.Sprintf("/account/%d/2fa/confirm", account.ID), token, OTPRequest{Code: "nope"}, &apiErr)
+	if resp.StatusCode != http.StatusUnauthorized || apiErr.Code != CodeInvalidOTP {
+		t.Fatalf("confirm with a wrong code: status %d, code %q", resp.StatusCode, apiErr.Code)
+	}
+
+	secret, counter, recovery := ts.enableTwoFactor(account, token)
+	if len(recovery) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes", len(recovery))
+	}
+
+	var challenge ChallengeResponse
+	ts.do("POST", "/login", "", login, &challenge)
+	if !challenge.TwoFactorRequired || challenge.ChallengeToken == "" {
+		t.Fatalf("login with two-factor: %+v", challenge)
+	}
+
+	if resp := ts.do("GET", fmt.Sprintf("/account/%d", account.ID), challenge.ChallengeToken, nil, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("challenge token used as access token: status %d", resp.StatusCode)
+	}
+
+	finish := func(code string) (*http.Response, TokenResponse) {
+		var tok TokenResponse
+		resp := ts.do("POST", "/login/2fa", "", TwoFactorLoginRequest{ChallengeToken: challenge.ChallengeToken, Code: code}, &tok)
+		return resp, tok
+	}
+
+	// the code that confirmed the enrollment is spent
+	if resp, _ := finish(totpAt(secret, counter)); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("reused code: status %d", resp.StatusCode)
+	}
+
+	if resp, tok := finish(totpAt(secret, counter+1)); resp.StatusCode != http.StatusOK || tok.Token == "" {
+		t.Fatalf("fresh code: status %d", resp.StatusCode)
+	}
+
+	if resp, _ := finish(strings.ToUpper(recovery[0])); resp.StatusCode != http.StatusOK {
+		t.Fatalf("recovery code: status %d", resp.StatusCode)
+	}
+	if resp, _ := finish(recovery[0]); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("recovery code used twice: status %d", resp.StatusCode)
+	}
+
+	// a recovery code also turns two-factor off
+	if resp := ts.do("POST", fmt.Sprintf("/account/%d/2fa/disable", account.ID), token, OTPRequest{Code: recovery[1]}, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("disable: status %d", resp.StatusCode)
+	}
+	if ts.do("POST", "/login", "", login, &tok); tok.Token == "" {
+		t.Fatal("login after disabling two-factor did not issue tokens")
+	}
+}
+
+func TestStepUpTransfer(t *testing.T) {
+	ts := newTestServer(t)
+
+	alice, aliceToken := ts.createAccount("Alice", "A", "secret-pass")
+	bob, _ := ts.createAccount("Bob", "B", "secret-pass")
+
+	if _, err := ts.store.Deposit(context.Background(), alice.ID, NewMoney(500000, "USD")); err != nil {
+		t.Fatal(err)
+	}
+
+	large := TransferRequest{ToAccount: bob.Number, Amount: int64(defaultConfig().StepUpThreshold) + 1, Currency: "USD"}
+
+	var apiErr ErrorResponse
+	resp := ts.do("POST", "/transfer", aliceToken, large, &apiErr)
+	if resp.StatusCode != http.StatusForbidden || apiErr.Code != CodeTwoFactorRequired {
+		t.Fatalf("large transfer without two-factor: status %d, code %q", resp.StatusCode, apiErr.Code)
+	}
+
+	if resp := ts.do("POST", "/transfer", aliceToken, TransferRequest{ToAccount: bob.Number, Amount: 100, Currency: "USD"}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("small transfer: status %d", resp.StatusCode)
+	}
+
+	secret, counter, _ := ts.enableTwoFactor(alice, aliceToken)
+
+	if resp := ts.doWithHeader("POST", "/transfer", aliceToken, idempotencyHeader, "large-1", large, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("large transfer without code: status %d", resp.StatusCode)
+	}
+
+	if resp := ts.doWithHeader("POST", "/transfer", aliceToken, stepUpHeader, totpAt(secret, counter), large, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("large transfer with a spent code: status %d", resp.StatusCode)
+	}
+
+	// the retry adds the code under the same idempotency key, the 403 must not be replayed
+	req, err := http.NewRequest("POST", ts.srv.URL+"/transfer", strings.NewReader(fmt.Sprintf(`{"toAccount":%d,"amount":%d,"currency":"USD"}`, large.ToAccount, large.Amount)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("token", aliceToken)
+	req.Header.Set(idempotencyHeader, "large-1")
+	req.Header.Set(stepUpHeader, totpAt(secret, counter+1))
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var got Account
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil || resp.StatusCode != http.StatusOK || got.Balance.Amount != 500000-100-large.Amount {
+		t.Fatalf("large transfer with a fresh code: status %d, balance %d, %v", resp.StatusCode, got.Balance.Amount, err)
+	}
+}
+
+func TestRefreshTokenRotationAndLogout(t *testing.T) {
+	ts := newTestServer(t)
+
+	account, _ := ts.createAccount("Ada", "Lovelace", "secret-pass")
+
+	var first TokenResponse
+	ts.do("POST", "/login", "", LoginRequest{Number: account.Number, Password: "secret-pass"}, &first)
+
+	var second TokenResponse
+	resp := ts.do("POST", "/token/refresh", "", RefreshRequest{RefreshToken: first.RefreshToken}, &second)
+	if resp.StatusCode != http.StatusOK || second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("refresh: status %d", resp.StatusCode)
+	}
+
+	// replaying a rotated token is treated as theft and kills the newer one too
+	if resp := ts.do("POST", "/token/refresh", "", RefreshRequest{RefreshToken: first.RefreshToken}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("reused refresh token: status %d", resp.StatusCode)
+	}
+	if resp := ts.do("POST", "/token/refresh", "", RefreshRequest{RefreshToken: second.RefreshToken}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("refresh after reuse: status %d", resp.StatusCode)
+	}
+
+	var third TokenResponse
+	ts.do("POST", "/login", "", LoginRequest{Number: account.Number, Password: "secret-pass"}, &third)
+
+	if resp := ts.do("POST", "/logout", "", RefreshRequest{RefreshToken: third.RefreshToken}, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("logout: status %d", resp.StatusCode)
+	}
+	if resp := ts.do("POST", "/token/refresh", "", RefreshRequest{RefreshToken: third.RefreshToken}, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("refresh after logout: status %d", resp.StatusCode)
+	}
+}
+
+func TestExpiredAccessTokenRejected(t *testing.T) {
+	ts := newTestServer(t)
+
+	account, _ := ts.createAccount("Ada", "Lovelace", "secret-pass")
+
+	issued := time.Now().Add(-time.Hour)
+	claims := &AccountClaims{
+		AccountNumber: account.Number,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    jwtIssuer,
+			Subject:   strconv.FormatInt(account.Number, 10),
+			IssuedAt:  jwt.NewNumericDate(issued),
+			ExpiresAt: jwt.NewNumericDate(issued.Add(accessTokenTTL)),
+		},
+	}
+	expired, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := ts.do("DELETE", fmt.Sprintf("/account/%d", account.ID), expired, nil, nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expired token: status %d", resp.StatusCode)
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	ts := newTestServer(t)
+
+	var apiErr ErrorResponse
+	resp := ts.do("POST", "/account", "", CreateAccountRequest{FirstName: " ", Password: "abc"}, &apiErr)
+	if resp.StatusCode != http.StatusBadRequest || apiErr.Code != CodeValidation {
+		t.Fatalf("invalid account: status %d, code %q", resp.StatusCode, apiErr.Code)
+	}
+	for _, field := range []string{"firstName", "lastName", "password"} {
+		if apiErr.Fields[field] == "" {
+			t.Errorf("no error reported for %s: %v", field, apiErr.Fields)
+		}
+	}
+
+	apiErr = ErrorResponse{}
+	body := map[string]any{"number": 1, "password": "secret-pass", "admin": true}
+	resp = ts.do("POST", "/login", "", body, &apiErr)
+	if resp.StatusCode != http.StatusBadRequest || apiErr.Fields["admin"] == "" {
+		t.Fatalf("unknown field: status %d, fields %v", resp.StatusCode, apiErr.Fields)
+	}
+
+	apiErr = ErrorResponse{}
+	huge := CreateAccountRequest{FirstName: "Ada", LastName: "Lovelace", Password: strings.Repeat("x", maxBodyBytes)}
+	resp = ts.do("POST", "/account", "", huge, &apiErr)
+	if resp.StatusCode != http.StatusRequestEntityTooLarge || apiErr.Code != CodeRequestTooLarge {
+		t.Fatalf("oversized body: status %d, code %q", resp.StatusCode, apiErr.Code)
+	}
+}
+
+func TestLegacyAccountNumber(t *testing.T) {
+	ts := newTestServer(t)
+
+	// numbers from before check digits were added mostly fail the Luhn check
+	legacy := NewAccount("Old", "Timer", "secret-pass", DefaultCurrency)
+	legacy.Number = 4242420
+	if validLuhn(legacy.Number) {
+		t.Fatal("test number should not pass the Luhn check")
+	}
+	if _, err := ts.store.CreateAccount(context.Background(), legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	var tok TokenResponse
+	if resp := ts.do("POST", "/login", "", LoginRequest{Number: legacy.Number, Password: "secret-pass"}, &tok); resp.StatusCode != http.StatusOK {
+		t.Fatalf("legacy login: status %d", resp.StatusCode)
+	}
+
+	alice, aliceToken := ts.createAccount("Alice", "A", "secret-pass")
+	if _, err := ts.store.Deposit(context.Background(), alice.ID, NewMoney(100, "USD")); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp := ts.do("POST", "/transfer", aliceToken, TransferRequest{ToAccount: legacy.Number, Amount: 10, Currency: "USD"}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("transfer to legacy account: status %d", resp.StatusCode)
+	}
+}
+
+func TestUpdateAccount(t *testing.T) {
+	ts := newTestServer(t)
+
+	account, token := ts.createAccount("Ada", "Byron", "secret-pass")
+	path := fmt.Sprintf("/account/%d", account.ID)
+
+	resp := ts.do("GET", path, token, nil, nil)
+	etag := resp.Header.Get("ETag")
+	if etag != `"1"` {
+		t.Fatalf("ETag %q, want \"1\"", etag)
+	}
+
+	lastName := "Lovelace"
+	update := UpdateAccountRequest{LastName: &lastName}
+
+	if resp := ts.do("PATCH", path, token, update, nil); resp.StatusCode != http.StatusPreconditionRequired {
+		t.Fatalf("PATCH without If-Match: status %d", resp.StatusCode)
+	}
+
+	var updated Account
+	if resp := ts.doWithHeader("PATCH", path, token, "If-Match", etag, update, &updated); resp.StatusCode != http.StatusOK || updated.LastName != lastName || updated.FirstName != "Ada" {
+		t.Fatalf("PATCH: status %d, account %+v", resp.StatusCode, updated)
+	}
+
+	if resp := ts.doWithHeader("PATCH", path, token, "If-Match", etag, update, nil); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Fatalf("PATCH with stale ETag: status %d", resp.StatusCode)
+	}
+
+	password := fmt.Sprintf("/account/%d/password", account.ID)
+
+	if resp := ts.do("POST", password, token, ChangePasswordRequest{CurrentPassword: "wrong-pass", NewPassword: "new-secret"}, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("wrong current password: status %d", resp.StatusCode)
+	}
+
+	if resp := ts.do("POST", password, token, ChangePasswordRequest{CurrentPassword: "secret-pass", NewPassword: "new-secret"}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("change password: status %d", resp.StatusCode)
+	}
+
+	if resp := ts.do("POST", "/login", "", LoginRequest{Number: account.Number, Password: "new-secret"}, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("login with new password: status %d", resp.StatusCode)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bankapi.env")
+	if err := os.WriteFile(file, []byte("BANKAPI_DB_HOST=from-file\nBANKAPI_DB_PORT=6000\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(t.TempDir(), "empty.env")
+	if err := os.WriteFile(empty, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		env      string
+		args     []string
+		wantHost string
+		wantPort int
+	}{
+		{"defaults", "", []string{"-config", empty}, "localhost", 5432},
+		{"file over defaults", "", []string{"-config", file}, "from-file", 6000},
+		{"env over file", "from-env", []string{"-config", file}, "from-env", 6000},
+		{"flag over env", "from-env", []string{"-config", file, "-db-host", "from-flag"}, "from-flag", 6000},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(envPrefix+"DB_HOST", tc.env)
+			t.Setenv(envPrefix+"DB_PORT", "")
+
+			cfg, err := LoadConfig(flag.NewFlagSet("test", flag.ContinueOnError), tc.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.DB.Host != tc.wantHost || cfg.DB.Port != tc.wantPort {
+				t.Fatalf("db %s:%d, want %s:%d", cfg.DB.Host, cfg.DB.Port, tc.wantHost, tc.wantPort)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+		args []string
+	}{
+		{"missing explicit config file", "", []string{"-config", filepath.Join(t.TempDir(), "missing.env")}},
+		{"bad number", "", []string{"-config", os.DevNull, "-db-port", "five"}},
+		{"bad duration from env", "soon", []string{"-config", os.DevNull}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(envPrefix+"READ_TIMEOUT", tc.env)
+
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			if _, err := LoadConfig(fs, tc.args); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestPrintConfigRedactsSecrets(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.DB.Password = "db-password-value"
+	cfg.JWTSecret = "jwt-secret-value"
+
+	var out bytes.Buffer
+	cfg.Print(&out)
+
+	for _, line := range []string{envPrefix + "DB_PASSWORD=[redacted]", envPrefix + "JWT_SECRET=[redacted]", envPrefix + "DB_HOST=localhost"} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "db-password-value") || strings.Contains(out.String(), "jwt-secret-value") {
+		t.Fatalf("secret printed:\n%s", out.String())
+	}
+
+	// an unset secret stays visibly unset
+	cfg.DB.Password = ""
+	out.Reset()
+	cfg.Print(&out)
+	if !strings.Contains(out.String(), envPrefix+"DB_PASSWORD=\n") {
+		t.Fatalf("empty password printed as:\n%s", out.String())
+	}
+}
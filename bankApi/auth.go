@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+)
+
+type contextKey int
+
+const callerKey contextKey = iota
+
+// withJWTAuth resolves the account behind the request's token once and stores it in the
+// request context, handlers and policies read it back with callerFromContext
+func (s *APIServer) withJWTAuth(handlerFunc http.HandlerFunc) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		tokenString := r.Header.Get("token")
+
+		claims, err := validateJWT(tokenString, s.jwtSecret)
+
+		if err != nil {
+			log.Println("invalid token")
+			writeError(w, unauthorized("permission denied"))
+			return
+		}
+
+		account, err := s.store.GetAccountByAccNumber(r.Context(), claims.AccountNumber)
+
+		if errors.Is(err, ErrAccountNotFound) || (err == nil && account.Status == StatusClosed) {
+			log.Println("token for unknown or closed account")
+			writeError(w, unauthorized("permission denied"))
+			return
+		}
+
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		// a role change makes older tokens stale, the client has to log in or refresh again
+		if claims.Role != account.Role {
+			log.Println("stale role in token")
+			writeError(w, unauthorized("permission denied"))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), callerKey, account)
+		handlerFunc(w, r.WithContext(ctx))
+	}
+}
+
+// callerFromContext returns the authenticated account, nil outside of withJWTAuth
+func callerFromContext(ctx context.Context) *Account {
+	account, _ := ctx.Value(callerKey).(*Account)
+	return account
+}
+
+// policy decides whether the authenticated caller may perform the request
+type policy func(caller *Account, r *http.Request) bool
+
+// authorize lets the request through when any of policies allows it, it must run behind withJWTAuth
+func authorize(handlerFunc http.HandlerFunc, policies ...policy) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		caller := callerFromContext(r.Context())
+
+		for _, allowed := range policies {
+			if caller != nil && allowed(caller, r) {
+				handlerFunc(w, r)
+				return
+			}
+		}
+
+		log.Println("permission denied for", r.Method, r.URL.Path)
+		writeError(w, forbidden("permission denied"))
+	}
+}
+
+// ownsAccount allows callers acting on their own {id}
+func ownsAccount(caller *Account, r *http.Request) bool {
+	id, err := getID(r)
+	return err == nil && id == caller.ID
+}
+
+// hasRole allows callers holding any of roles
+func hasRole(roles ...Role) policy {
+	return func(caller *Account, r *http.Request) bool {
+		for _, role := range roles {
+			if caller.Role == role {
+				return true
+			}
+		}
+		return false
+	}
+}
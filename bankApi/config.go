@@ -0,0 +1,332 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// envPrefix namespaces every environment variable the server reads
+const envPrefix = "BANKAPI_"
+
+type DBConfig struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	Name     string
+	SSLMode  string
+
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+}
+
+// DSN builds the Postgres connection URL, escaping credentials as needed
+func (c DBConfig) DSN() string {
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(c.User, c.Password),
+		Host:     net.JoinHostPort(c.Host, strconv.Itoa(c.Port)),
+		Path:     "/" + c.Name,
+		RawQuery: url.Values{"sslmode": {c.SSLMode}}.Encode(),
+	}
+	return u.String()
+}
+
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+}
+
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+type Config struct {
+	ListenAddr   string
+	Store        string
+	DB           DBConfig
+	TLS          TLSConfig
+	JWTSecret    string
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	RequestTimeout  time.Duration
+	ShutdownTimeout time.Duration
+
+	// StatementTimeout replaces RequestTimeout and WriteTimeout for streamed statements
+	StatementTimeout time.Duration
+
+	// MaxStatements caps the statements streamed at once. Each one holds a database
+	// connection until the client has read it all, so they must leave room in the pool.
+	MaxStatements int
+
+	RatesFile string
+
+	SchedulerInterval time.Duration
+
+	// StepUpThreshold is the transfer amount, in minor units of DefaultCurrency, above which
+	// a TOTP code is required. 0 turns step-up off.
+	StepUpThreshold int
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddr: ":8080",
+		Store:      "postgres",
+		DB: DBConfig{
+			Host:    "localhost",
+			Port:    5432,
+			Name:    "goproj",
+			SSLMode: "disable",
+
+			MaxOpenConns:    25,
+			MaxIdleConns:    10,
+			ConnMaxLifetime: 30 * time.Minute,
+			ConnMaxIdleTime: 5 * time.Minute,
+		},
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  60 * time.Second,
+
+		RequestTimeout:  5 * time.Second,
+		ShutdownTimeout: 30 * time.Second,
+
+		StatementTimeout: 5 * time.Minute,
+		MaxStatements:    5,
+
+		SchedulerInterval: 30 * time.Second,
+
+		StepUpThreshold: 100000,
+	}
+}
+
+// setting ties one config field to its flag and its BANKAPI_ environment variable / file key
+type setting struct {
+	flag   string
+	env    string
+	usage  string
+	value  any
+	secret bool
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"listen", "LISTEN_ADDR", "address to listen on", &c.ListenAddr, false},
+		{"store", "STORE", "storage backend: postgres or memory", &c.Store, false},
+		{"db-host", "DB_HOST", "Postgres host", &c.DB.Host, false},
+		{"db-port", "DB_PORT", "Postgres port", &c.DB.Port, false},
+		{"db-user", "DB_USER", "Postgres user", &c.DB.User, false},
+		{"db-password", "DB_PASSWORD", "Postgres password", &c.DB.Password, true},
+		{"db-name", "DB_NAME", "Postgres database name", &c.DB.Name, false},
+		{"db-sslmode", "DB_SSLMODE", "Postgres sslmode", &c.DB.SSLMode, false},
+		{"db-max-open-conns", "DB_MAX_OPEN_CONNS", "maximum open connections in the pool", &c.DB.MaxOpenConns, false},
+		{"db-max-idle-conns", "DB_MAX_IDLE_CONNS", "maximum idle connections kept in the pool", &c.DB.MaxIdleConns, false},
+		{"db-conn-max-lifetime", "DB_CONN_MAX_LIFETIME", "how long a connection may be reused", &c.DB.ConnMaxLifetime, false},
+		{"db-conn-max-idle-time", "DB_CONN_MAX_IDLE_TIME", "how long a connection may sit idle", &c.DB.ConnMaxIdleTime, false},
+		{"tls-cert", "TLS_CERT_FILE", "TLS certificate file, serves HTTPS when set", &c.TLS.CertFile, false},
+		{"tls-key", "TLS_KEY_FILE", "TLS private key file", &c.TLS.KeyFile, false},
+		{"jwt-secret", "JWT_SECRET", "HMAC secret used to sign tokens", &c.JWTSecret, true},
+		{"read-timeout", "READ_TIMEOUT", "maximum time to read a request", &c.ReadTimeout, false},
+		{"write-timeout", "WRITE_TIMEOUT", "maximum time to write a response", &c.WriteTimeout, false},
+		{"idle-timeout", "IDLE_TIMEOUT", "how long idle keep-alive connections stay open", &c.IdleTimeout, false},
+		{"request-timeout", "REQUEST_TIMEOUT", "deadline for handling a single request, storage calls included", &c.RequestTimeout, false},
+		{"shutdown-timeout", "SHUTDOWN_TIMEOUT", "how long to wait for in-flight requests when stopping", &c.ShutdownTimeout, false},
+		{"statement-timeout", "STATEMENT_TIMEOUT", "deadline for streaming an account statement", &c.StatementTimeout, false},
+		{"max-statements", "MAX_STATEMENTS", "account statements streamed at once, each holds a db connection while it streams", &c.MaxStatements, false},
+		{"rates-file", "RATES_FILE", "JSON file with the exchange rates loaded at startup", &c.RatesFile, false},
+		{"scheduler-interval", "SCHEDULER_INTERVAL", "how often to look for due scheduled transfers", &c.SchedulerInterval, false},
+		{"step-up-threshold", "STEP_UP_THRESHOLD", "transfers above this many minor units of " + string(DefaultCurrency) + " need a TOTP code, 0 to turn off", &c.StepUpThreshold, false},
+	}
+}
+
+// LoadConfig registers the config flags on fs and parses args. Later sources win:
+// defaults, then the config file, then BANKAPI_ environment variables, then flags.
+// The config file uses the same KEY=value lines as the environment, e.g. BANKAPI_DB_HOST=db.
+func LoadConfig(fs *flag.FlagSet, args []string) (*Config, error) {
+	cfg := defaultConfig()
+	settings := cfg.settings()
+
+	configFile := fs.String("config", ".env", "optional file with BANKAPI_ settings")
+
+	// flags are only collected here and applied last so they override the other sources
+	flagged := map[string]string{}
+	for _, s := range settings {
+		name := s.flag
+		fs.Func(name, s.usage+" (env "+envPrefix+s.env+")", func(val string) error {
+			flagged[name] = val
+			return nil
+		})
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	fileValues, err := godotenv.Read(*configFile)
+	if err != nil {
+		// the default file is optional, one that was asked for is not
+		if !errors.Is(err, os.ErrNotExist) || isFlagSet(fs, "config") {
+			return nil, fmt.Errorf("reading config file: %w", err)
+		}
+	}
+
+	for _, s := range settings {
+		sources := []struct {
+			name string
+			val  string
+			ok   bool
+		}{
+			{"config file " + *configFile, fileValues[envPrefix+s.env], fileValues[envPrefix+s.env] != ""},
+			{"environment", os.Getenv(envPrefix + s.env), os.Getenv(envPrefix+s.env) != ""},
+			{"flag", flagged[s.flag], flagged[s.flag] != ""},
+		}
+
+		for _, src := range sources {
+			if !src.ok {
+				continue
+			}
+			if err := setValue(s.value, src.val); err != nil {
+				return nil, fmt.Errorf("%s %s: %w", src.name, envPrefix+s.env, err)
+			}
+		}
+	}
+
+	return cfg, nil
+}
+
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func setValue(ptr any, val string) error {
+	switch p := ptr.(type) {
+	case *string:
+		*p = val
+	case *int:
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", val)
+		}
+		*p = n
+	case *time.Duration:
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration", val)
+		}
+		*p = d
+	default:
+		panic(fmt.Sprintf("unsupported setting type %T", ptr))
+	}
+	return nil
+}
+
+// Validate reports every problem with the config at once
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.ListenAddr == "" {
+		errs = append(errs, fmt.Errorf("listen address is required"))
+	}
+
+	switch c.Store {
+	case "postgres":
+		if c.DB.Host == "" || c.DB.Name == "" || c.DB.User == "" {
+			errs = append(errs, fmt.Errorf("db host, name and user are required for the postgres store"))
+		}
+		if c.DB.Port < 1 || c.DB.Port > 65535 {
+			errs = append(errs, fmt.Errorf("db port %d is out of range", c.DB.Port))
+		}
+		if c.DB.MaxOpenConns < 1 || c.DB.MaxIdleConns < 0 || c.DB.MaxIdleConns > c.DB.MaxOpenConns {
+			errs = append(errs, fmt.Errorf("db pool needs at least 1 open connection and no more idle than open ones"))
+		}
+		if c.DB.ConnMaxLifetime < 0 || c.DB.ConnMaxIdleTime < 0 {
+			errs = append(errs, fmt.Errorf("db connection lifetimes can't be negative"))
+		}
+		if c.MaxStatements >= c.DB.MaxOpenConns {
+			errs = append(errs, fmt.Errorf("max statements should be below db max open conns, or statements can take the whole pool"))
+		}
+	case "memory":
+	default:
+		errs = append(errs, fmt.Errorf("unknown store %q", c.Store))
+	}
+
+	if len(c.JWTSecret) < 32 {
+		errs = append(errs, fmt.Errorf("jwt secret should be at least 32 characters"))
+	}
+
+	if c.TLS.Enabled() && (c.TLS.CertFile == "" || c.TLS.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("tls needs both a certificate and a key file"))
+	}
+
+	for _, file := range []string{c.TLS.CertFile, c.TLS.KeyFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			errs = append(errs, fmt.Errorf("tls file: %w", err))
+		}
+	}
+
+	for _, d := range []time.Duration{c.ReadTimeout, c.WriteTimeout, c.IdleTimeout, c.RequestTimeout, c.ShutdownTimeout, c.StatementTimeout} {
+		if d <= 0 {
+			errs = append(errs, fmt.Errorf("timeouts should be positive"))
+			break
+		}
+	}
+
+	if c.MaxStatements < 1 {
+		errs = append(errs, fmt.Errorf("max statements should be at least 1"))
+	}
+
+	if c.SchedulerInterval <= 0 {
+		errs = append(errs, fmt.Errorf("scheduler interval should be positive"))
+	}
+
+	if c.StepUpThreshold < 0 {
+		errs = append(errs, fmt.Errorf("step-up threshold can't be negative"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Print writes the config in config file format with secrets redacted
+func (c *Config) Print(w io.Writer) {
+	for _, s := range c.settings() {
+		val := fmt.Sprint(settingValue(s.value))
+		if s.secret && val != "" {
+			val = "[redacted]"
+		}
+		fmt.Fprintf(w, "%s%s=%s\n", envPrefix, s.env, val)
+	}
+}
+
+// settingValue dereferences a setting pointer for printing
+func settingValue(ptr any) any {
+	switch p := ptr.(type) {
+	case *string:
+		return *p
+	case *int:
+		return *p
+	case *time.Duration:
+		return *p
+	}
+	return ptr
+}
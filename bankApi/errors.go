@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+)
+
+// Stable error codes clients can branch on, the message next to them is for humans only
+const (
+	CodeValidation   = "validation_failed"
+	CodeUnauthorized = "unauthorized"
+	CodeForbidden    = "forbidden"
+	CodeNotFound     = "not_found"
+	CodeConflict     = "conflict"
+	CodeInternal     = "internal"
+	CodeTimeout      = "timeout"
+	CodeCanceled     = "request_canceled"
+
+	CodeInvalidJSON         = "invalid_json"
+	CodeRequestTooLarge     = "request_too_large"
+	CodeInvalidCredentials  = "invalid_credentials"
+	CodeInvalidRefreshToken = "invalid_refresh_token"
+	CodeAccountNotFound     = "account_not_found"
+	CodeInvalidAmount       = "invalid_amount"
+	CodeSelfTransfer        = "self_transfer"
+	CodeInsufficientFunds   = "insufficient_funds"
+	CodeIdempotencyMismatch = "idempotency_key_reused"
+	CodeIdempotencyPending  = "idempotency_key_in_progress"
+	CodeVersionMismatch     = "version_mismatch"
+	CodeVersionRequired     = "version_required"
+	CodeAccountNotActive    = "account_not_active"
+	CodeBalanceNotZero      = "balance_not_zero"
+	CodeInvalidTransition   = "invalid_status_transition"
+	CodeCurrencyMismatch    = "currency_mismatch"
+	CodeNoExchangeRate      = "no_exchange_rate"
+	CodeScheduleNotFound    = "schedule_not_found"
+	CodeTooManyAttempts     = "too_many_attempts"
+	CodeTooManyStatements   = "too_many_statements"
+	CodeTwoFactorRequired   = "two_factor_required"
+	CodeTwoFactorNotSetUp   = "two_factor_not_set_up"
+	CodeTwoFactorEnabled    = "two_factor_enabled"
+	CodeInvalidOTP          = "invalid_otp"
+)
+
+// APIError is an error that knows how it should be reported to the client.
+// Fields holds per-field problems keyed by JSON name, Err holds the underlying cause
+// which is logged for internal errors but never sent out.
+type APIError struct {
+	Status  int
+	Code    string
+	Message string
+	Fields  map[string]string
+	Err     error
+}
+
+func (e *APIError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorResponse is the body of every error response
+type ErrorResponse struct {
+	Error  string            `json:"error"`
+	Code   string            `json:"code"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+func newAPIError(status int, code string, message string) *APIError {
+	return &APIError{Status: status, Code: code, Message: message}
+}
+
+func validationError(message string) *APIError {
+	return newAPIError(http.StatusBadRequest, CodeValidation, message)
+}
+
+func unauthorized(message string) *APIError {
+	return newAPIError(http.StatusUnauthorized, CodeUnauthorized, message)
+}
+
+func forbidden(message string) *APIError {
+	return newAPIError(http.StatusForbidden, CodeForbidden, message)
+}
+
+func notFound(message string) *APIError {
+	return newAPIError(http.StatusNotFound, CodeNotFound, message)
+}
+
+func conflict(message string) *APIError {
+	return newAPIError(http.StatusConflict, CodeConflict, message)
+}
+
+func internalError(err error) *APIError {
+	return &APIError{Status: http.StatusInternalServerError, Code: CodeInternal, Message: "internal server error", Err: err}
+}
+
+// statusClientClosedRequest is the non-standard status nginx uses when the client went away
+const statusClientClosedRequest = 499
+
+// knownErrors maps the sentinel errors returned by storage to what the client sees
+var knownErrors = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{ErrAccountNotFound, http.StatusNotFound, CodeAccountNotFound},
+	{ErrInvalidAmount, http.StatusBadRequest, CodeInvalidAmount},
+	{ErrSelfTransfer, http.StatusUnprocessableEntity, CodeSelfTransfer},
+	{ErrInsufficientFunds, http.StatusUnprocessableEntity, CodeInsufficientFunds},
+	{ErrVersionMismatch, http.StatusPreconditionFailed, CodeVersionMismatch},
+	{ErrAccountNotActive, http.StatusUnprocessableEntity, CodeAccountNotActive},
+	{ErrBalanceNotZero, http.StatusConflict, CodeBalanceNotZero},
+	{ErrInvalidStatusTransition, http.StatusConflict, CodeInvalidTransition},
+	{ErrCurrencyMismatch, http.StatusUnprocessableEntity, CodeCurrencyMismatch},
+	{ErrNoExchangeRate, http.StatusUnprocessableEntity, CodeNoExchangeRate},
+	{ErrScheduleNotFound, http.StatusNotFound, CodeScheduleNotFound},
+	{ErrInvalidScheduleTransition, http.StatusConflict, CodeInvalidTransition},
+	{ErrRefreshTokenNotFound, http.StatusUnauthorized, CodeInvalidRefreshToken},
+	{ErrInvalidCredentials, http.StatusUnauthorized, CodeInvalidCredentials},
+	{ErrTwoFactorNotEnrolled, http.StatusConflict, CodeTwoFactorNotSetUp},
+	{ErrTwoFactorEnabled, http.StatusConflict, CodeTwoFactorEnabled},
+	{ErrInvalidOTP, http.StatusUnauthorized, CodeInvalidOTP},
+}
+
+// toAPIError classifies err, anything unrecognised is an internal error
+func toAPIError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &APIError{Status: http.StatusGatewayTimeout, Code: CodeTimeout, Message: "request timed out", Err: err}
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return &APIError{Status: statusClientClosedRequest, Code: CodeCanceled, Message: "request was canceled", Err: err}
+	}
+
+	for _, known := range knownErrors {
+		if errors.Is(err, known.err) {
+			return newAPIError(known.status, known.code, known.err.Error())
+		}
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &APIError{Status: http.StatusBadRequest, Code: CodeInvalidJSON, Message: "request body is not valid JSON", Err: err}
+	}
+
+	return internalError(err)
+}
+
+// writeError sends err to the client, internal details only go to the log
+func writeError(w http.ResponseWriter, err error) {
+	apiErr := toAPIError(err)
+
+	if apiErr.Status >= http.StatusInternalServerError {
+		log.Println("internal error:", err)
+	}
+
+	WriteJson(w, apiErr.Status, ErrorResponse{Error: apiErr.Message, Code: apiErr.Code, Fields: apiErr.Fields})
+}
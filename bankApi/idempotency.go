@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const idempotencyHeader = "Idempotency-Key"
+
+var (
+	ErrIdempotencyKeyExists   = errors.New("idempotency key already exists")
+	ErrIdempotencyKeyNotFound = errors.New("idempotency key not found")
+)
+
+// IdempotencyRecord stores the outcome of a money-moving request so a retry with the
+// same Idempotency-Key replays it instead of running twice
+type IdempotencyRecord struct {
+	Key         string
+	RequestHash string
+	StatusCode  int // 0 while the first request is still being handled
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+// responseRecorder passes the response through while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// withIdempotency makes handlerFunc safe to retry when the client sends an Idempotency-Key,
+// requests without the header are passed through untouched. It must run behind withJWTAuth.
+func withIdempotency(handlerFunc http.HandlerFunc, s Storage) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" {
+			handlerFunc(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+		if err != nil {
+			writeError(w, decodeError(err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// keys are scoped to the caller so two clients can't collide
+		caller := callerFromContext(r.Context())
+
+		record := &IdempotencyRecord{
+			Key:         fmt.Sprintf("%d:%s", caller.Number, key),
+			RequestHash: hashRequest(r, body),
+			CreatedAt:   time.Now().UTC(),
+		}
+
+		err = s.CreateIdempotencyRecord(r.Context(), record)
+
+		if errors.Is(err, ErrIdempotencyKeyExists) {
+			replayIdempotent(w, r, record, s)
+			return
+		}
+
+		if err != nil {
+			writeError(w, internalError(err))
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		handlerFunc(rec, r)
+
+		// the result has to be stored even if the client already gave up waiting for it
+		ctx := context.WithoutCancel(r.Context())
+
+		// a server error, timeout or cancellation is no final answer, the key is released
+		// so the retry runs for real
+		if !replayable(rec.status) {
+			if err := s.DeleteIdempotencyRecord(ctx, record.Key); err != nil {
+				log.Println("idempotency:", err)
+			}
+			return
+		}
+
+		record.StatusCode = rec.status
+		record.Body = rec.body.Bytes()
+
+		if err := s.CompleteIdempotencyRecord(ctx, record); err != nil {
+			log.Println("idempotency:", err)
+		}
+	}
+}
+
+// replayable reports whether a response with status is what every retry should get.
+// 401 and 403 depend on headers the request hash leaves out, like the X-OTP step-up code,
+// so a retry that adds them must run again.
+func replayable(status int) bool {
+	switch {
+	case status >= 200 && status < 300:
+		return true
+	case status == http.StatusUnauthorized, status == http.StatusForbidden:
+		return false
+	case status == http.StatusRequestTimeout, status == http.StatusTooManyRequests, status == statusClientClosedRequest:
+		return false
+	}
+	return status >= 400 && status < 500
+}
+
+func replayIdempotent(w http.ResponseWriter, r *http.Request, record *IdempotencyRecord, s Storage) {
+
+	stored, err := s.GetIdempotencyRecord(r.Context(), record.Key)
+	if err != nil {
+		writeError(w, internalError(err))
+		return
+	}
+
+	if stored.RequestHash != record.RequestHash {
+		writeError(w, newAPIError(http.StatusUnprocessableEntity, CodeIdempotencyMismatch, "idempotency key was already used for a different request"))
+		return
+	}
+
+	if stored.StatusCode == 0 {
+		writeError(w, newAPIError(http.StatusConflict, CodeIdempotencyPending, "a request with this idempotency key is still in progress"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(stored.StatusCode)
+	w.Write(stored.Body)
+}
+
+func hashRequest(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method))
+	h.Write([]byte{0})
+	h.Write([]byte(r.URL.Path))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
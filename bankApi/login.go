@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrInvalidCredentials is the only answer to a failed login, whether the account exists or not
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// LoginAttempt counts the recent failed logins for one key, an account number or a client IP
+type LoginAttempt struct {
+	Key           string
+	Failures      int
+	LastFailureAt time.Time
+}
+
+// loginPolicy decides how long a key has to wait after its failures. The first free
+// failures cost nothing, each one after that doubles the wait, and from lockAfter on
+// the key is locked out. Failures older than loginAttemptWindow are forgotten.
+type loginPolicy struct {
+	free      int
+	lockAfter int
+	lockout   time.Duration
+}
+
+const loginAttemptWindow = 24 * time.Hour
+
+var (
+	accountLoginPolicy = loginPolicy{free: 3, lockAfter: 10, lockout: 15 * time.Minute}
+
+	// many customers can share an address behind NAT, so an IP gets more room
+	ipLoginPolicy = loginPolicy{free: 20, lockAfter: 100, lockout: 15 * time.Minute}
+)
+
+// reserve counts a try at now as a failure up front, so concurrent tries can't all slip
+// through on the same count. It returns when the key may try again instead if it is
+// blocked, leaving attempt untouched. Failures before forgetBefore start over.
+func (p loginPolicy) reserve(attempt *LoginAttempt, now, forgetBefore time.Time) time.Time {
+	if attempt.LastFailureAt.Before(forgetBefore) {
+		attempt.Failures = 0
+	}
+
+	if until := p.blockedUntil(attempt); until.After(now) {
+		return until
+	}
+
+	attempt.Failures++
+	attempt.LastFailureAt = now
+	return time.Time{}
+}
+
+// release takes back a try reserved at reservedAt. The last failure goes back to previous,
+// what it was before the reservation, unless a later try has moved it on since, so a
+// right password doesn't restart the wait of a key that is backing off.
+func (a *LoginAttempt) release(reservedAt, previous time.Time) {
+	if a.Failures > 0 {
+		a.Failures--
+	}
+	if a.LastFailureAt.Equal(reservedAt) {
+		a.LastFailureAt = previous
+	}
+}
+
+// blockedUntil is when the key may try again, the zero time if it may try now
+func (p loginPolicy) blockedUntil(attempt *LoginAttempt) time.Time {
+	if attempt.Failures <= p.free {
+		return time.Time{}
+	}
+
+	if attempt.Failures >= p.lockAfter {
+		return attempt.LastFailureAt.Add(p.lockout)
+	}
+
+	// past 2^30 seconds the wait is beyond any lockout, and the shift would overflow further on
+	doublings := attempt.Failures - p.free - 1
+	if doublings >= 30 {
+		return attempt.LastFailureAt.Add(p.lockout)
+	}
+
+	delay := min(time.Second<<doublings, p.lockout)
+	return attempt.LastFailureAt.Add(delay)
+}
+
+type loginKey struct {
+	key    string
+	policy loginPolicy
+}
+
+// loginReservation is a try counted against key at, previous is the last failure before it
+type loginReservation struct {
+	key      string
+	at       time.Time
+	previous time.Time
+}
+
+// loginKeys are the counters a login for number from r is checked against. The IP is the
+// connection's remote address, proxy headers are not trusted since clients can set them.
+func loginKeys(r *http.Request, number int64) []loginKey {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	return []loginKey{
+		{"account:" + strconv.FormatInt(number, 10), accountLoginPolicy},
+		{"ip:" + ip, ipLoginPolicy},
+	}
+}
+
+// reserveLoginAttempt counts the coming try as a failure against every key before the
+// credentials are checked, or refuses with 429 and Retry-After while any key is backing off.
+// A try that turns out right, or never got to check anything, is handed back with
+// releaseLoginAttempt.
+func (s *APIServer) reserveLoginAttempt(ctx context.Context, w http.ResponseWriter, keys []loginKey) ([]loginReservation, error) {
+	// cut to the microseconds a timestamp column keeps, so a release can tell its own
+	// reservation from a later one
+	now := s.now().UTC().Truncate(time.Microsecond)
+	reservations := make([]loginReservation, 0, len(keys))
+
+	for _, k := range keys {
+		until, previous, err := s.store.ReserveLoginAttempt(ctx, k.key, k.policy, now, now.Add(-loginAttemptWindow))
+
+		if err == nil && until.IsZero() {
+			reservations = append(reservations, loginReservation{k.key, now, previous})
+			continue
+		}
+
+		// the keys reserved so far didn't get their try after all
+		s.releaseLoginAttempt(ctx, reservations)
+
+		if err != nil {
+			return nil, err
+		}
+
+		wait := int(until.Sub(now).Seconds()) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(wait))
+		return nil, newAPIError(http.StatusTooManyRequests, CodeTooManyAttempts, fmt.Sprintf("too many failed logins, try again in %d seconds", wait))
+	}
+
+	return reservations, nil
+}
+
+// releaseLoginAttempt takes back the failures reserveLoginAttempt counted. It runs after
+// the outcome is known, so it only logs when storage fails.
+func (s *APIServer) releaseLoginAttempt(ctx context.Context, reservations []loginReservation) {
+	for _, res := range reservations {
+		if err := s.store.ReleaseLoginAttempt(context.WithoutCancel(ctx), res.key, res.at, res.previous); err != nil {
+			log.Println("releasing login attempt:", err)
+		}
+	}
+}
+
+// dummyPasswordHash is compared against when the account doesn't exist, so a login for an
+// unknown number takes as long as a wrong password
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte("not the password of any account"), passwordCost)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+})
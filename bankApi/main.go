@@ -1,30 +1,105 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"log"
-
-	"github.com/joho/godotenv"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
 
-	err := godotenv.Load()
+	fs := flag.NewFlagSet("bankApi", flag.ExitOnError)
+	printConfig := fs.Bool("print-config", false, "print the resolved config with secrets redacted and exit")
+	makeAdmin := fs.Int64("make-admin", 0, "give the account with this number the admin role and exit")
+
+	config, err := LoadConfig(fs, os.Args[1:])
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		log.Fatal(err)
+	}
+
+	if *printConfig {
+		config.Print(os.Stdout)
+		if err := config.Validate(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if fs.Arg(0) == "migrate" {
+		store, err := NewPostgresStore(config.DB)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := runMigrate(store, fs.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err := config.Validate(); err != nil {
+		log.Fatal(err)
 	}
 
-	store, err := NewPostgresStore()
+	store, err := newStore(config)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	fmt.Printf("%+v\n", store)
+	// the first admin has to be created out of band since only admins can change roles
+	if *makeAdmin != 0 {
+		account, err := store.GetAccountByAccNumber(context.Background(), *makeAdmin)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if _, err := store.UpdateAccountRole(context.Background(), account.ID, RoleAdmin); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	if err := store.Init(); err != nil {
+	rates, err := LoadRateTable(config.RatesFile)
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	server := newAPIServer(":8080", store)
-	server.Run()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := newAPIServer(config, store, rates)
+	runErr := server.Run(ctx)
+
+	if err := store.Close(); err != nil {
+		log.Println("closing store:", err)
+	}
+
+	if runErr != nil {
+		log.Fatal(runErr)
+	}
+}
+
+// newStore builds the configured Storage, Postgres has to be migrated to this binary's schema
+func newStore(config *Config) (Storage, error) {
+	switch config.Store {
+	case "postgres":
+		store, err := NewPostgresStore(config.DB)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := store.CheckSchema(); err != nil {
+			return nil, err
+		}
+
+		return store, nil
+	case "memory":
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown store %q", config.Store)
+	}
 }
@@ -0,0 +1,798 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Storage kept entirely in memory, for tests and running without Postgres.
+// It mirrors PostgresStore's behaviour, returning copies so callers can't mutate stored data.
+type MemoryStore struct {
+	mu           sync.Mutex
+	accounts     map[int]*Account
+	nextID       int
+	transactions []*Transaction
+	idempotency  map[string]*IdempotencyRecord
+	refresh      map[string]*RefreshToken
+	schedules    map[int]*TransferSchedule
+	scheduleRuns []*ScheduleRun
+	logins       map[string]*LoginAttempt
+	twoFactor    map[int64]*TwoFactor
+	recovery     map[int64]map[string]bool
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		accounts:    map[int]*Account{},
+		nextID:      1,
+		idempotency: map[string]*IdempotencyRecord{},
+		refresh:     map[string]*RefreshToken{},
+		schedules:   map[int]*TransferSchedule{},
+		logins:      map[string]*LoginAttempt{},
+		twoFactor:   map[int64]*TwoFactor{},
+		recovery:    map[int64]map[string]bool{},
+	}
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) LoginAccount(ctx context.Context, req *LoginRequest) (*Account, error) {
+	return loginAccount(ctx, s, req)
+}
+
+func (s *MemoryStore) CreateAccount(ctx context.Context, account *Account) (*Account, error) {
+	return createWithUniqueNumber(ctx, account, s.insertAccount)
+}
+
+func (s *MemoryStore) insertAccount(ctx context.Context, account *Account) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.findByNumber(account.Number) != nil {
+		return nil, ErrAccountNumberTaken
+	}
+
+	created := *account
+	created.ID = s.nextID
+	s.nextID++
+	s.accounts[created.ID] = &created
+
+	log.Println("Account Created")
+
+	copied := created
+	return &copied, nil
+}
+
+func (s *MemoryStore) GetAccountByID(ctx context.Context, id int) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok := s.accounts[id]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+
+	copied := *account
+	return &copied, nil
+}
+
+func (s *MemoryStore) GetAccountByAccNumber(ctx context.Context, number int64) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account := s.findByNumber(number)
+	if account == nil {
+		return nil, ErrAccountNotFound
+	}
+
+	copied := *account
+	return &copied, nil
+}
+
+func (s *MemoryStore) GetAccounts(ctx context.Context, filter *AccountFilter) (*AccountPage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	matched := []*Account{}
+	for _, account := range s.accounts {
+		if matchesAccountFilter(account, filter) {
+			copied := *account
+			matched = append(matched, &copied)
+		}
+	}
+
+	less := func(a, b *Account) bool {
+		if filter.Desc {
+			return compareAccounts(a, b, filter.Sort) > 0
+		}
+		return compareAccounts(a, b, filter.Sort) < 0
+	}
+
+	sort.Slice(matched, func(i, j int) bool { return less(matched[i], matched[j]) })
+
+	page := &AccountPage{Total: len(matched), Accounts: matched}
+
+	if filter.After != nil {
+		after := &Account{
+			ID:        filter.After.ID,
+			CreatedAt: filter.After.CreatedAt,
+			Balance:   NewMoney(filter.After.Balance, ""),
+			LastName:  filter.After.LastName,
+			FirstName: filter.After.FirstName,
+		}
+		start := sort.Search(len(matched), func(i int) bool { return less(after, matched[i]) })
+		page.Accounts = matched[start:]
+	}
+
+	if len(page.Accounts) > filter.Limit {
+		page.Accounts = page.Accounts[:filter.Limit]
+		page.Next = newAccountCursor(page.Accounts[filter.Limit-1], filter)
+	}
+
+	return page, nil
+}
+
+func matchesAccountFilter(account *Account, filter *AccountFilter) bool {
+	if filter.NamePrefix != "" {
+		prefix := strings.ToLower(filter.NamePrefix)
+		if !strings.HasPrefix(strings.ToLower(account.FirstName), prefix) && !strings.HasPrefix(strings.ToLower(account.LastName), prefix) {
+			return false
+		}
+	}
+	if filter.Status != "" && account.Status != filter.Status {
+		return false
+	}
+	if filter.Currency != "" && account.Balance.Currency != filter.Currency {
+		return false
+	}
+	if filter.MinBalance != nil && account.Balance.Amount < *filter.MinBalance {
+		return false
+	}
+	if filter.MaxBalance != nil && account.Balance.Amount > *filter.MaxBalance {
+		return false
+	}
+	return true
+}
+
+// compareAccounts orders accounts the way accountSortColumns does in Postgres
+func compareAccounts(a, b *Account, sort AccountSort) int {
+	switch sort {
+	case SortBalance:
+		if a.Balance.Amount != b.Balance.Amount {
+			return cmp.Compare(a.Balance.Amount, b.Balance.Amount)
+		}
+	case SortName:
+		if c := strings.Compare(a.LastName, b.LastName); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.FirstName, b.FirstName); c != 0 {
+			return c
+		}
+	default:
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(a.ID, b.ID)
+}
+
+func (s *MemoryStore) UpdateAccountRole(ctx context.Context, id int, role Role) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok := s.accounts[id]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+
+	account.Role = role
+	log.Printf("Account %d is now %s\n", id, role)
+
+	copied := *account
+	return &copied, nil
+}
+
+func (s *MemoryStore) UpdateAccount(ctx context.Context, id int, update *AccountUpdate, version int) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok := s.accounts[id]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+
+	if version != 0 && account.Version != version {
+		return nil, ErrVersionMismatch
+	}
+
+	if update.FirstName != nil {
+		account.FirstName = *update.FirstName
+	}
+	if update.LastName != nil {
+		account.LastName = *update.LastName
+	}
+	if update.EncryptedPassword != nil {
+		account.EncryptedPassword = *update.EncryptedPassword
+	}
+	account.Version++
+	account.UpdatedAt = time.Now().UTC()
+
+	log.Printf("Account %d updated to version %d\n", id, account.Version)
+
+	copied := *account
+	return &copied, nil
+}
+
+func (s *MemoryStore) ChangeAccountStatus(ctx context.Context, id int, status AccountStatus, reason string) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok := s.accounts[id]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+
+	if err := checkStatusChange(account, status); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	account.Status = status
+	account.StatusReason = reason
+	account.StatusChangedAt = &now
+	account.Version++
+	account.UpdatedAt = now
+
+	log.Printf("Account %d is now %s: %s\n", id, status, reason)
+
+	copied := *account
+	return &copied, nil
+}
+
+func (s *MemoryStore) Transfer(ctx context.Context, from int64, req *TransferRequest, rates *RateTable) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	source, err := s.transfer(from, req, rates)
+	if err != nil {
+		return nil, err
+	}
+
+	copied := *source
+	return &copied, nil
+}
+
+// transfer is Transfer for callers already holding s.mu
+func (s *MemoryStore) transfer(from int64, req *TransferRequest, rates *RateTable) (*Account, error) {
+
+	if req.Amount <= 0 {
+		return nil, ErrInvalidAmount
+	}
+
+	if req.ToAccount == from {
+		return nil, ErrSelfTransfer
+	}
+
+	dest := s.findByNumber(req.ToAccount)
+	if dest == nil {
+		return nil, ErrAccountNotFound
+	}
+
+	source := s.findByNumber(from)
+	if source == nil {
+		return nil, ErrAccountNotFound
+	}
+
+	entry, err := planTransfer(source, dest, req.Money(), rates)
+	if err != nil {
+		return nil, err
+	}
+
+	s.insertTransaction(entry)
+
+	log.Printf("Transferred %s from %d to %d\n", entry.Amount, from, req.ToAccount)
+
+	return source, nil
+}
+
+func (s *MemoryStore) Deposit(ctx context.Context, id int, amount Money) (*Account, error) {
+	return s.adjustBalance(ctx, id, amount, TransactionDeposit)
+}
+
+func (s *MemoryStore) Withdraw(ctx context.Context, id int, amount Money) (*Account, error) {
+	return s.adjustBalance(ctx, id, amount, TransactionWithdrawal)
+}
+
+func (s *MemoryStore) adjustBalance(ctx context.Context, id int, amount Money, kind string) (*Account, error) {
+
+	if amount.Amount <= 0 {
+		return nil, ErrInvalidAmount
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok := s.accounts[id]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+
+	entry, err := planBalanceChange(account, amount, kind)
+	if err != nil {
+		return nil, err
+	}
+
+	s.insertTransaction(entry)
+
+	log.Printf("%s of %s on account %d\n", kind, entry.Amount, account.Number)
+
+	copied := *account
+	return &copied, nil
+}
+
+func (s *MemoryStore) GetTransactions(ctx context.Context, number int64, filter *TransactionFilter) ([]*Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	matched := []*Transaction{}
+
+	for _, transaction := range s.transactions {
+		if transaction.FromAccount != number && transaction.ToAccount != number {
+			continue
+		}
+		if !filter.From.IsZero() && transaction.CreatedAt.Before(filter.From) {
+			continue
+		}
+		if !filter.To.IsZero() && !transaction.CreatedAt.Before(filter.To) {
+			continue
+		}
+
+		copied := *transaction
+		matched = append(matched, &copied)
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		if !matched[i].CreatedAt.Equal(matched[j].CreatedAt) {
+			return matched[i].CreatedAt.Before(matched[j].CreatedAt)
+		}
+		return matched[i].ID < matched[j].ID
+	})
+
+	if filter.Offset >= len(matched) {
+		return []*Transaction{}, nil
+	}
+	matched = matched[filter.Offset:]
+
+	if len(matched) > filter.Limit {
+		matched = matched[:filter.Limit]
+	}
+
+	return matched, nil
+}
+
+func (s *MemoryStore) GetStatement(ctx context.Context, id int, from, to time.Time, w StatementWriter) error {
+	s.mu.Lock()
+
+	account, ok := s.accounts[id]
+	if !ok {
+		s.mu.Unlock()
+		return ErrAccountNotFound
+	}
+
+	statement := &Statement{Account: account, From: from, To: to, Opening: account.Balance}
+	entries := []*Transaction{}
+
+	for _, transaction := range s.transactions {
+		if transaction.FromAccount != account.Number && transaction.ToAccount != account.Number {
+			continue
+		}
+		if transaction.CreatedAt.Before(from) {
+			continue
+		}
+
+		// the opening balance is the current one minus everything booked since from
+		statement.Opening.Amount -= transaction.netAmount(account.Number)
+		if transaction.CreatedAt.Before(to) {
+			copied := *transaction
+			entries = append(entries, &copied)
+		}
+	}
+
+	copied := *account
+	statement.Account = &copied
+	s.mu.Unlock()
+
+	if err := w.Begin(statement); err != nil {
+		return err
+	}
+
+	balance := statement.Opening
+
+	for _, transaction := range entries {
+		line := nextStatementLine(statement, balance, transaction)
+		if err := w.Line(line); err != nil {
+			return err
+		}
+		balance = line.Balance
+	}
+
+	statement.Closing = balance
+	return w.End(statement)
+}
+
+func (s *MemoryStore) CreateIdempotencyRecord(ctx context.Context, record *IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.idempotency[record.Key]; ok {
+		return ErrIdempotencyKeyExists
+	}
+
+	stored := *record
+	stored.StatusCode = 0
+	stored.Body = nil
+	s.idempotency[record.Key] = &stored
+
+	return nil
+}
+
+func (s *MemoryStore) GetIdempotencyRecord(ctx context.Context, key string) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.idempotency[key]
+	if !ok {
+		return nil, ErrIdempotencyKeyNotFound
+	}
+
+	copied := *record
+	copied.Body = append([]byte(nil), record.Body...)
+	return &copied, nil
+}
+
+func (s *MemoryStore) CompleteIdempotencyRecord(ctx context.Context, record *IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.idempotency[record.Key]
+	if !ok {
+		return nil
+	}
+
+	stored.StatusCode = record.StatusCode
+	stored.Body = append([]byte(nil), record.Body...)
+
+	return nil
+}
+
+func (s *MemoryStore) DeleteIdempotencyRecord(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.idempotency, key)
+	return nil
+}
+
+func (s *MemoryStore) CreateRefreshToken(ctx context.Context, token *RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.refresh[token.TokenHash]; ok {
+		return fmt.Errorf("refresh token already exists")
+	}
+
+	stored := *token
+	s.refresh[token.TokenHash] = &stored
+
+	return nil
+}
+
+func (s *MemoryStore) GetRefreshToken(ctx context.Context, hash string) (*RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.refresh[hash]
+	if !ok {
+		return nil, ErrRefreshTokenNotFound
+	}
+
+	copied := *token
+	return &copied, nil
+}
+
+func (s *MemoryStore) RevokeRefreshToken(ctx context.Context, hash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.refresh[hash]
+	if !ok || token.RevokedAt != nil {
+		return false, nil
+	}
+
+	now := time.Now().UTC()
+	token.RevokedAt = &now
+
+	return true, nil
+}
+
+func (s *MemoryStore) RevokeAccountRefreshTokens(ctx context.Context, number int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	for _, token := range s.refresh {
+		if token.AccountNumber == number && token.RevokedAt == nil {
+			token.RevokedAt = &now
+		}
+	}
+
+	return nil
+}
+
+// findByNumber returns the stored account with the lowest id for number, callers must hold mu
+func (s *MemoryStore) findByNumber(number int64) *Account {
+	var found *Account
+	for _, account := range s.accounts {
+		if account.Number == number && (found == nil || account.ID < found.ID) {
+			found = account
+		}
+	}
+	return found
+}
+
+// insertTransaction appends a completed ledger entry, callers must hold mu
+func (s *MemoryStore) insertTransaction(transaction *Transaction) {
+	transaction.ID = len(s.transactions) + 1
+	transaction.Status = TransactionCompleted
+	transaction.CreatedAt = time.Now().UTC()
+	s.transactions = append(s.transactions, transaction)
+}
+
+func (s *MemoryStore) ReserveLoginAttempt(ctx context.Context, key string, policy loginPolicy, now, forgetBefore time.Time) (until, previous time.Time, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempt := LoginAttempt{Key: key}
+	if stored, ok := s.logins[key]; ok {
+		attempt = *stored
+	}
+
+	previous = attempt.LastFailureAt
+	if until := policy.reserve(&attempt, now, forgetBefore); !until.IsZero() {
+		return until, time.Time{}, nil
+	}
+
+	s.logins[key] = &attempt
+	return time.Time{}, previous, nil
+}
+
+func (s *MemoryStore) ReleaseLoginAttempt(ctx context.Context, key string, reservedAt, previous time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if attempt, ok := s.logins[key]; ok {
+		attempt.release(reservedAt, previous)
+	}
+	return nil
+}
+
+func (s *MemoryStore) ResetLoginAttempts(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.logins, key)
+	return nil
+}
+
+func (s *MemoryStore) GetTwoFactor(ctx context.Context, number int64) (*TwoFactor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tf, ok := s.twoFactor[number]
+	if !ok {
+		return nil, ErrTwoFactorNotEnrolled
+	}
+
+	copied := *tf
+	return &copied, nil
+}
+
+func (s *MemoryStore) SaveTwoFactor(ctx context.Context, tf *TwoFactor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.twoFactor[tf.AccountNumber].Enabled() {
+		return ErrTwoFactorEnabled
+	}
+
+	stored := *tf
+	stored.ConfirmedAt = nil
+	stored.LastCounter = 0
+	s.twoFactor[tf.AccountNumber] = &stored
+	return nil
+}
+
+func (s *MemoryStore) ConfirmTwoFactor(ctx context.Context, tf *TwoFactor, recoveryHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.twoFactor[tf.AccountNumber]
+	if !ok || stored.Enabled() || stored.Secret != tf.Secret {
+		return ErrTwoFactorNotEnrolled
+	}
+
+	confirmedAt := *tf.ConfirmedAt
+	stored.ConfirmedAt = &confirmedAt
+	stored.LastCounter = tf.LastCounter
+
+	codes := map[string]bool{}
+	for _, hash := range recoveryHashes {
+		codes[hash] = false
+	}
+	s.recovery[tf.AccountNumber] = codes
+
+	return nil
+}
+
+func (s *MemoryStore) UseTOTPCounter(ctx context.Context, number int64, counter int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tf, ok := s.twoFactor[number]
+	if !ok || !tf.Enabled() || tf.LastCounter >= counter {
+		return false, nil
+	}
+
+	tf.LastCounter = counter
+	return true, nil
+}
+
+func (s *MemoryStore) UseRecoveryCode(ctx context.Context, number int64, hash string, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	used, ok := s.recovery[number][hash]
+	if !ok || used {
+		return false, nil
+	}
+
+	s.recovery[number][hash] = true
+	return true, nil
+}
+
+func (s *MemoryStore) DeleteTwoFactor(ctx context.Context, number int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.twoFactor, number)
+	delete(s.recovery, number)
+	return nil
+}
+
+func (s *MemoryStore) CreateSchedule(ctx context.Context, schedule *TransferSchedule) (*TransferSchedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *schedule
+	stored.ID = len(s.schedules) + 1
+	s.schedules[stored.ID] = &stored
+
+	copied := stored
+	return &copied, nil
+}
+
+func (s *MemoryStore) GetSchedule(ctx context.Context, id int) (*TransferSchedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schedule, ok := s.schedules[id]
+	if !ok {
+		return nil, ErrScheduleNotFound
+	}
+
+	copied := *schedule
+	return &copied, nil
+}
+
+func (s *MemoryStore) GetSchedules(ctx context.Context, number int64) ([]*TransferSchedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schedules := []*TransferSchedule{}
+	for _, schedule := range s.schedules {
+		if schedule.AccountNumber == number {
+			copied := *schedule
+			schedules = append(schedules, &copied)
+		}
+	}
+
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].ID > schedules[j].ID })
+
+	return schedules, nil
+}
+
+func (s *MemoryStore) UpdateScheduleStatus(ctx context.Context, id int, status ScheduleStatus) (*TransferSchedule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schedule, ok := s.schedules[id]
+	if !ok {
+		return nil, ErrScheduleNotFound
+	}
+
+	if !schedule.Status.CanBecome(status) {
+		return nil, ErrInvalidScheduleTransition
+	}
+
+	changeScheduleStatus(schedule, status, time.Now().UTC())
+
+	copied := *schedule
+	return &copied, nil
+}
+
+func (s *MemoryStore) GetDueSchedules(ctx context.Context, now time.Time, limit int) ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	due := []*TransferSchedule{}
+	for _, schedule := range s.schedules {
+		if schedule.Status == ScheduleActive && !schedule.NextAttemptAt.After(now) {
+			due = append(due, schedule)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool { return due[i].NextAttemptAt.Before(due[j].NextAttemptAt) })
+
+	ids := []int{}
+	for _, schedule := range due[:min(limit, len(due))] {
+		ids = append(ids, schedule.ID)
+	}
+
+	return ids, nil
+}
+
+func (s *MemoryStore) RunSchedule(ctx context.Context, id int, now time.Time, rates *RateTable) (*ScheduleRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schedule, ok := s.schedules[id]
+	if !ok {
+		return nil, ErrScheduleNotFound
+	}
+
+	if schedule.Status != ScheduleActive || schedule.NextAttemptAt.After(now) {
+		return nil, nil
+	}
+
+	_, err := s.transfer(schedule.AccountNumber, schedule.transferRequest(), rates)
+
+	run := recordScheduleRun(schedule, err, now)
+	run.ID = len(s.scheduleRuns) + 1
+	s.scheduleRuns = append(s.scheduleRuns, run)
+
+	copied := *run
+	return &copied, nil
+}
+
+func (s *MemoryStore) GetScheduleRuns(ctx context.Context, id int) ([]*ScheduleRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	runs := []*ScheduleRun{}
+	for _, run := range s.scheduleRuns {
+		if run.ScheduleID == id {
+			copied := *run
+			runs = append(runs, &copied)
+		}
+	}
+
+	return runs, nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID keys the advisory lock that keeps two processes from migrating at once
+const migrationLockID = 7260413
+
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// loadMigrations reads the embedded migrations, ordered by version
+func loadMigrations() ([]*migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+
+	for _, entry := range entries {
+		match := migrationName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file %s", entry.Name())
+		}
+
+		version, _ := strconv.Atoi(match[1])
+
+		body, err := fs.ReadFile(migrationFiles, "migrations/"+entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: match[2]}
+			byVersion[version] = m
+		} else if m.name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.name, match[2])
+		}
+
+		if match[3] == "up" {
+			m.up = string(body)
+		} else {
+			m.down = string(body)
+		}
+	}
+
+	migrations := []*migration{}
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", m.version, m.name)
+		}
+		migrations = append(migrations, m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+
+	return migrations, nil
+}
+
+func (s *PostgresStore) createMigrationsTable() error {
+	query := `
+		CREATE TABLE if not exists schema_migrations(
+		version int primary key,
+		name text not null,
+		applied_at timestamp not null
+	)`
+
+	_, err := s.db.Exec(query)
+	return err
+}
+
+// SchemaVersion returns the highest applied migration, 0 for an empty database
+func (s *PostgresStore) SchemaVersion() (int, error) {
+	if err := s.createMigrationsTable(); err != nil {
+		return 0, err
+	}
+
+	return schemaVersion(s.db)
+}
+
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func schemaVersion(q queryRower) (int, error) {
+	var version int
+	err := q.QueryRow(`select coalesce(max(version), 0) from schema_migrations`).Scan(&version)
+	return version, err
+}
+
+// MigrateUp applies every pending migration, each in its own transaction
+func (s *PostgresStore) MigrateUp() error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	if err := s.createMigrationsTable(); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		err := s.inMigrationTx(func(tx *sql.Tx, current int) error {
+			if m.version <= current {
+				return nil
+			}
+
+			if _, err := tx.Exec(m.up); err != nil {
+				return fmt.Errorf("migration %d_%s: %w", m.version, m.name, err)
+			}
+
+			_, err := tx.Exec(`insert into schema_migrations (version, name, applied_at) values ($1, $2, $3)`, m.version, m.name, time.Now().UTC())
+			if err == nil {
+				log.Printf("Applied migration %d_%s\n", m.version, m.name)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MigrateDown reverts the latest steps migrations
+func (s *PostgresStore) MigrateDown(steps int) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	if err := s.createMigrationsTable(); err != nil {
+		return err
+	}
+
+	for i := 0; i < steps; i++ {
+		err := s.inMigrationTx(func(tx *sql.Tx, current int) error {
+			if current == 0 {
+				return fmt.Errorf("no migrations left to revert")
+			}
+
+			m := findMigration(migrations, current)
+			if m == nil {
+				return fmt.Errorf("database is at version %d which this binary does not know", current)
+			}
+
+			if _, err := tx.Exec(m.down); err != nil {
+				return fmt.Errorf("reverting migration %d_%s: %w", m.version, m.name, err)
+			}
+
+			_, err := tx.Exec(`delete from schema_migrations where version=$1`, m.version)
+			if err == nil {
+				log.Printf("Reverted migration %d_%s\n", m.version, m.name)
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CheckSchema refuses to serve from a database that is behind or ahead of this binary
+func (s *PostgresStore) CheckSchema() error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	current, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	latest := migrations[len(migrations)-1].version
+
+	if current < latest {
+		return fmt.Errorf("database schema is at version %d but %d is required, run `bankApi migrate up`", current, latest)
+	}
+
+	if current > latest {
+		return fmt.Errorf("database schema is at version %d which is newer than this binary (%d)", current, latest)
+	}
+
+	return nil
+}
+
+// inMigrationTx runs fn in a transaction holding the migration lock, passing it the current version
+func (s *PostgresStore) inMigrationTx(fn func(tx *sql.Tx, current int) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`select pg_advisory_xact_lock($1)`, migrationLockID); err != nil {
+		return err
+	}
+
+	current, err := schemaVersion(tx)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx, current); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func findMigration(migrations []*migration, version int) *migration {
+	for _, m := range migrations {
+		if m.version == version {
+			return m
+		}
+	}
+	return nil
+}
+
+// runMigrate implements the `migrate up|down [steps]|status` subcommand
+func runMigrate(store *PostgresStore, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: bankApi migrate up|down [steps]|status")
+	}
+
+	switch args[0] {
+	case "up":
+		return store.MigrateUp()
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("steps should be a positive number")
+			}
+			steps = n
+		}
+		return store.MigrateDown(steps)
+	case "status":
+		migrations, err := loadMigrations()
+		if err != nil {
+			return err
+		}
+
+		current, err := store.SchemaVersion()
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			state := "pending"
+			if m.version <= current {
+				state = "applied"
+			}
+			fmt.Printf("%04d_%s\t%s\n", m.version, m.name, state)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
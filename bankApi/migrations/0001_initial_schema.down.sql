@@ -0,0 +1,4 @@
+DROP TABLE if exists refresh_token;
+DROP TABLE if exists idempotency_key;
+DROP TABLE if exists transaction;
+DROP TABLE if exists account;
@@ -0,0 +1,42 @@
+-- Baseline: the tables PostgresStore.Init used to create. Everything is "if not exists"
+-- so databases that predate migrations adopt this version without changes.
+CREATE TABLE if not exists account(
+	id serial primary key,
+	first_name text,
+	last_name text,
+	number text,
+	password text,
+	balance serial,
+	created_at timestamp
+);
+ALTER TABLE account add column if not exists role text not null default 'customer';
+CREATE UNIQUE INDEX if not exists account_number_key on account(number);
+
+CREATE TABLE if not exists transaction(
+	id serial primary key,
+	from_account bigint,
+	to_account bigint,
+	amount bigint not null,
+	type text not null,
+	status text not null,
+	created_at timestamp not null
+);
+CREATE INDEX if not exists transaction_from_account_idx on transaction(from_account, created_at);
+CREATE INDEX if not exists transaction_to_account_idx on transaction(to_account, created_at);
+
+CREATE TABLE if not exists idempotency_key(
+	key text primary key,
+	request_hash text not null,
+	status_code int not null default 0,
+	body bytea,
+	created_at timestamp not null
+);
+
+CREATE TABLE if not exists refresh_token(
+	token_hash text primary key,
+	account_number bigint not null,
+	expires_at timestamp not null,
+	created_at timestamp not null,
+	revoked_at timestamp
+);
+CREATE INDEX if not exists refresh_token_account_idx on refresh_token(account_number);
@@ -0,0 +1,10 @@
+ALTER TABLE account alter column created_at drop not null;
+ALTER TABLE account alter column balance drop default;
+ALTER TABLE account alter column balance drop not null;
+ALTER TABLE account alter column password drop not null;
+ALTER TABLE account alter column number drop not null;
+ALTER TABLE account alter column last_name drop not null;
+ALTER TABLE account alter column first_name drop not null;
+
+ALTER TABLE account alter column balance type integer;
+ALTER TABLE account alter column number type text using number::text;
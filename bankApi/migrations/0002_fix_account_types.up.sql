@@ -0,0 +1,13 @@
+-- number was text and balance a serial (an int4 with a sequence default), store both as plain bigints
+ALTER TABLE account alter column number type bigint using number::bigint;
+ALTER TABLE account alter column balance drop default;
+ALTER TABLE account alter column balance type bigint;
+DROP SEQUENCE if exists account_balance_seq;
+
+ALTER TABLE account alter column first_name set not null;
+ALTER TABLE account alter column last_name set not null;
+ALTER TABLE account alter column number set not null;
+ALTER TABLE account alter column password set not null;
+ALTER TABLE account alter column balance set not null;
+ALTER TABLE account alter column balance set default 0;
+ALTER TABLE account alter column created_at set not null;
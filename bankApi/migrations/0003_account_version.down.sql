@@ -0,0 +1,2 @@
+ALTER TABLE account drop column updated_at;
+ALTER TABLE account drop column version;
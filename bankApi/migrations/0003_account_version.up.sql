@@ -0,0 +1,5 @@
+-- version backs optimistic concurrency (ETag / If-Match) on account updates
+ALTER TABLE account add column version int not null default 1;
+ALTER TABLE account add column updated_at timestamp;
+UPDATE account set updated_at = created_at;
+ALTER TABLE account alter column updated_at set not null;
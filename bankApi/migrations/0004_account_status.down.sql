@@ -0,0 +1,3 @@
+ALTER TABLE account drop column status_changed_at;
+ALTER TABLE account drop column status_reason;
+ALTER TABLE account drop column status;
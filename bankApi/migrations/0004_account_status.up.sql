@@ -0,0 +1,4 @@
+-- accounts are closed instead of deleted so their ledger stays auditable
+ALTER TABLE account add column status text not null default 'active';
+ALTER TABLE account add column status_reason text not null default '';
+ALTER TABLE account add column status_changed_at timestamp;
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS account_last_name_prefix_idx;
+DROP INDEX IF EXISTS account_first_name_prefix_idx;
+DROP INDEX IF EXISTS account_name_idx;
+DROP INDEX IF EXISTS account_balance_idx;
+DROP INDEX IF EXISTS account_created_at_idx;
@@ -0,0 +1,6 @@
+-- keyset pagination on GET /account walks these, see PostgresStore.GetAccounts
+CREATE INDEX account_created_at_idx on account (created_at, id);
+CREATE INDEX account_balance_idx on account (balance, id);
+CREATE INDEX account_name_idx on account (last_name, first_name, id);
+CREATE INDEX account_first_name_prefix_idx on account (lower(first_name) text_pattern_ops);
+CREATE INDEX account_last_name_prefix_idx on account (lower(last_name) text_pattern_ops);
@@ -0,0 +1,5 @@
+ALTER TABLE transaction drop column rate;
+ALTER TABLE transaction drop column credited_currency;
+ALTER TABLE transaction drop column credited_amount;
+ALTER TABLE transaction drop column currency;
+ALTER TABLE account drop column currency;
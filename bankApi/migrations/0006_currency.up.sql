@@ -0,0 +1,9 @@
+-- balances and ledger amounts are in the minor units of their currency,
+-- everything that existed before currencies is taken to be USD
+ALTER TABLE account add column currency text not null default 'USD';
+ALTER TABLE transaction add column currency text not null default 'USD';
+
+-- set on cross-currency transfers, what the receiving account got and the rate applied
+ALTER TABLE transaction add column credited_amount bigint;
+ALTER TABLE transaction add column credited_currency text;
+ALTER TABLE transaction add column rate numeric;
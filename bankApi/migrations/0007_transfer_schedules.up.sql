@@ -0,0 +1,35 @@
+-- standing orders sent by the scheduler in APIServer.runScheduler
+CREATE TABLE transfer_schedule(
+	id serial primary key,
+	account_number bigint not null,
+	to_account bigint not null,
+	amount bigint not null,
+	currency text not null,
+	frequency text not null,
+	start_at timestamp not null,
+	end_at timestamp,
+	status text not null,
+	run_at timestamp not null,
+	next_attempt_at timestamp not null,
+	attempts int not null default 0,
+	runs int not null default 0,
+	last_error text not null default '',
+	created_at timestamp not null,
+	updated_at timestamp not null
+);
+CREATE INDEX transfer_schedule_account_idx on transfer_schedule(account_number);
+CREATE INDEX transfer_schedule_due_idx on transfer_schedule(next_attempt_at) where status = 'active';
+
+CREATE TABLE transfer_schedule_run(
+	id serial primary key,
+	schedule_id int not null,
+	scheduled_for timestamp not null,
+	attempt int not null,
+	status text not null,
+	error text not null default '',
+	created_at timestamp not null
+);
+CREATE INDEX transfer_schedule_run_schedule_idx on transfer_schedule_run(schedule_id);
+
+-- backs the exactly once guarantee, an occurrence can only complete once
+CREATE UNIQUE INDEX transfer_schedule_run_once_key on transfer_schedule_run(schedule_id, scheduled_for) where status = 'completed';
@@ -0,0 +1,6 @@
+-- failed login counters keyed by "account:<number>" or "ip:<address>", see login.go
+CREATE TABLE login_attempt(
+	key text primary key,
+	failures int not null,
+	last_failure_at timestamp not null
+);
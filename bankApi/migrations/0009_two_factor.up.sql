@@ -0,0 +1,16 @@
+-- TOTP enrollments, see twofactor.go. last_counter is the time step of the last code used.
+CREATE TABLE two_factor(
+	account_number bigint primary key,
+	secret text not null,
+	confirmed_at timestamp,
+	last_counter bigint not null default 0,
+	created_at timestamp not null
+);
+
+-- one-time recovery codes, only their sha256 is kept
+CREATE TABLE recovery_code(
+	account_number bigint not null,
+	code_hash text not null,
+	used_at timestamp,
+	primary key (account_number, code_hash)
+);
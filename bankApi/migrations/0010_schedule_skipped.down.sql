@@ -0,0 +1 @@
+ALTER TABLE transfer_schedule DROP COLUMN IF EXISTS skipped;
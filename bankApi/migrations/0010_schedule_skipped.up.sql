@@ -0,0 +1,2 @@
+-- occurrences passed over while a schedule was paused, see skipMissedOccurrences
+ALTER TABLE transfer_schedule ADD COLUMN skipped int not null default 0;
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Currency is an ISO 4217 code
+type Currency string
+
+// DefaultCurrency is used for accounts opened without one, and for rows that predate currencies
+const DefaultCurrency Currency = "USD"
+
+// minorUnits holds the supported currencies and how many decimals each one has
+var minorUnits = map[Currency]int{
+	"AUD": 2, "BHD": 3, "BRL": 2, "CAD": 2, "CHF": 2, "CLP": 0, "CNY": 2,
+	"CZK": 2, "DKK": 2, "EUR": 2, "GBP": 2, "HKD": 2, "INR": 2, "ISK": 0,
+	"JOD": 3, "JPY": 0, "KRW": 0, "KWD": 3, "MXN": 2, "NOK": 2, "NZD": 2,
+	"OMR": 3, "PLN": 2, "SEK": 2, "SGD": 2, "TND": 3, "USD": 2, "VND": 0,
+	"ZAR": 2,
+}
+
+func (c Currency) Valid() bool {
+	_, ok := minorUnits[c]
+	return ok
+}
+
+func (c Currency) MinorUnits() int {
+	return minorUnits[c]
+}
+
+var ErrCurrencyMismatch = errors.New("amount currency does not match the account currency")
+
+// Money is an amount in the minor units of its currency, cents for USD, yen for JPY.
+// Amounts in different currencies can't be added or subtracted, they have to go
+// through RateTable.Convert first.
+type Money struct {
+	Amount   int64    `json:"amount"`
+	Currency Currency `json:"currency"`
+}
+
+func NewMoney(amount int64, currency Currency) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+// Add returns ErrInvalidAmount rather than a sum that doesn't fit in an int64
+func (m Money) Add(other Money) (Money, error) {
+	if m.Currency != other.Currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+
+	sum := m.Amount + other.Amount
+	if (other.Amount > 0 && sum < m.Amount) || (other.Amount < 0 && sum > m.Amount) {
+		return Money{}, ErrInvalidAmount
+	}
+	return Money{Amount: sum, Currency: m.Currency}, nil
+}
+
+// Sub returns ErrInvalidAmount rather than a difference that doesn't fit in an int64
+func (m Money) Sub(other Money) (Money, error) {
+	if m.Currency != other.Currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+
+	diff := m.Amount - other.Amount
+	if (other.Amount > 0 && diff > m.Amount) || (other.Amount < 0 && diff < m.Amount) {
+		return Money{}, ErrInvalidAmount
+	}
+	return Money{Amount: diff, Currency: m.Currency}, nil
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+// String formats m in major units, e.g. "12.34 USD"
+func (m Money) String() string {
+	return m.Decimal() + " " + string(m.Currency)
+}
+
+// Decimal is the amount in major units without the currency, e.g. "-12.34"
+func (m Money) Decimal() string {
+	units := m.Currency.MinorUnits()
+	if units == 0 {
+		return fmt.Sprintf("%d", m.Amount)
+	}
+
+	sign, amount := "", m.Amount
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+
+	digits := fmt.Sprintf("%0*d", units+1, amount)
+	cut := len(digits) - units
+	return sign + digits[:cut] + "." + digits[cut:]
+}
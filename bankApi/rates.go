@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrNoExchangeRate = errors.New("no exchange rate between these currencies")
+
+// ExchangeRate says one unit of From buys Rate units of To. Rate is a decimal string
+// so it survives JSON without float rounding.
+type ExchangeRate struct {
+	From Currency `json:"from"`
+	To   Currency `json:"to"`
+	Rate string   `json:"rate"`
+}
+
+// RatesRequest is both the body of PUT /rates and the format of the rates file
+type RatesRequest struct {
+	Rates []ExchangeRate `json:"rates" validate:"required"`
+}
+
+type ratePair struct {
+	from, to Currency
+}
+
+// RateTable holds the exchange rates used for cross-currency transfers. Only the
+// pairs it was given are used, USD->EUR is not derived from EUR->USD.
+type RateTable struct {
+	mu    sync.RWMutex
+	rates map[ratePair]*big.Rat
+}
+
+func NewRateTable() *RateTable {
+	return &RateTable{rates: map[ratePair]*big.Rat{}}
+}
+
+// LoadRateTable reads a RatesRequest JSON file, an empty path gives an empty table
+func LoadRateTable(path string) (*RateTable, error) {
+	table := NewRateTable()
+	if path == "" {
+		return table, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	req := new(RatesRequest)
+	if err := json.Unmarshal(data, req); err != nil {
+		return nil, fmt.Errorf("reading rates file %s: %w", path, err)
+	}
+
+	if err := table.Set(req.Rates); err != nil {
+		return nil, fmt.Errorf("reading rates file %s: %w", path, err)
+	}
+
+	return table, nil
+}
+
+// Set replaces every rate at once, nothing changes if any of them is invalid
+func (t *RateTable) Set(rates []ExchangeRate) error {
+	parsed := map[ratePair]*big.Rat{}
+
+	for i, rate := range rates {
+		if !rate.From.Valid() || !rate.To.Valid() {
+			return validationError(fmt.Sprintf("rates[%d]: unsupported currency", i))
+		}
+		if rate.From == rate.To {
+			return validationError(fmt.Sprintf("rates[%d]: from and to are the same currency", i))
+		}
+
+		value, ok := new(big.Rat).SetString(rate.Rate)
+		if !ok || value.Sign() <= 0 {
+			return validationError(fmt.Sprintf("rates[%d]: rate should be a positive decimal", i))
+		}
+
+		parsed[ratePair{rate.From, rate.To}] = value
+	}
+
+	t.mu.Lock()
+	t.rates = parsed
+	t.mu.Unlock()
+
+	return nil
+}
+
+func (t *RateTable) Rates() []ExchangeRate {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	rates := []ExchangeRate{}
+	for pair, value := range t.rates {
+		rates = append(rates, ExchangeRate{From: pair.from, To: pair.to, Rate: formatRate(value)})
+	}
+
+	sort.Slice(rates, func(i, j int) bool {
+		if rates[i].From != rates[j].From {
+			return rates[i].From < rates[j].From
+		}
+		return rates[i].To < rates[j].To
+	})
+
+	return rates
+}
+
+// Convert turns m into currency to, rounding half away from zero to the minor units of to.
+// It also returns the rate it applied, "" when no conversion was needed.
+func (t *RateTable) Convert(m Money, to Currency) (Money, string, error) {
+	if m.Currency == to {
+		return m, "", nil
+	}
+
+	t.mu.RLock()
+	rate, ok := t.rates[ratePair{m.Currency, to}]
+	t.mu.RUnlock()
+
+	if !ok {
+		return Money{}, "", ErrNoExchangeRate
+	}
+
+	value := new(big.Rat).SetInt64(m.Amount)
+	value.Mul(value, rate)
+	value.Mul(value, pow10(to.MinorUnits()-m.Currency.MinorUnits()))
+
+	quo, rem := new(big.Int).QuoRem(value.Num(), value.Denom(), new(big.Int))
+	if rem.Abs(rem).Lsh(rem, 1).Cmp(value.Denom()) >= 0 {
+		quo.Add(quo, big.NewInt(int64(value.Sign())))
+	}
+
+	if !quo.IsInt64() {
+		return Money{}, "", ErrInvalidAmount
+	}
+
+	return Money{Amount: quo.Int64(), Currency: to}, formatRate(rate), nil
+}
+
+func pow10(exp int) *big.Rat {
+	if exp < 0 {
+		return new(big.Rat).SetFrac(big.NewInt(1), new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(-exp)), nil))
+	}
+	return new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exp)), nil))
+}
+
+// formatRate writes rate with up to 10 decimals and no trailing zeros
+func formatRate(rate *big.Rat) string {
+	s := rate.FloatString(10)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+func (s *APIServer) handleGetRates(w http.ResponseWriter, r *http.Request) error {
+	return WriteJson(w, http.StatusOK, RatesRequest{Rates: s.rates.Rates()})
+}
+
+// handleSetRates replaces the whole rate table, it lasts until the next restart
+// which loads the rates file again
+func (s *APIServer) handleSetRates(w http.ResponseWriter, r *http.Request) error {
+	req := new(RatesRequest)
+	if err := decodeJSON(w, r, req); err != nil {
+		return err
+	}
+
+	if err := s.rates.Set(req.Rates); err != nil {
+		return err
+	}
+
+	return WriteJson(w, http.StatusOK, RatesRequest{Rates: s.rates.Rates()})
+}
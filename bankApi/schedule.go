@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+type ScheduleFrequency string
+
+const (
+	FrequencyOnce    ScheduleFrequency = "once"
+	FrequencyDaily   ScheduleFrequency = "daily"
+	FrequencyWeekly  ScheduleFrequency = "weekly"
+	FrequencyMonthly ScheduleFrequency = "monthly"
+)
+
+func (f ScheduleFrequency) Valid() bool {
+	switch f {
+	case FrequencyOnce, FrequencyDaily, FrequencyWeekly, FrequencyMonthly:
+		return true
+	}
+	return false
+}
+
+type ScheduleStatus string
+
+const (
+	ScheduleActive    ScheduleStatus = "active"
+	SchedulePaused    ScheduleStatus = "paused"
+	ScheduleCancelled ScheduleStatus = "cancelled"
+	ScheduleCompleted ScheduleStatus = "completed"
+	ScheduleFailed    ScheduleStatus = "failed"
+)
+
+// scheduleTransitions are the status changes a customer can make, completed and failed
+// are only set by the scheduler
+var scheduleTransitions = map[ScheduleStatus][]ScheduleStatus{
+	ScheduleActive: {SchedulePaused, ScheduleCancelled},
+	SchedulePaused: {ScheduleActive, ScheduleCancelled},
+}
+
+func (s ScheduleStatus) CanBecome(next ScheduleStatus) bool {
+	for _, allowed := range scheduleTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// maxScheduleAttempts is how often one run is tried before it is given up
+	maxScheduleAttempts = 5
+	scheduleRetryDelay  = time.Minute
+	maxScheduleRetry    = time.Hour
+	scheduleBatchSize   = 100
+)
+
+var (
+	ErrScheduleNotFound          = errors.New("schedule not found")
+	ErrInvalidScheduleTransition = errors.New("schedule status can not change that way")
+)
+
+// ScheduleRequest is a TransferRequest with a time to send it and how often to repeat it,
+// an empty Frequency means once
+type ScheduleRequest struct {
+	TransferRequest
+	StartAt   time.Time         `json:"startAt" validate:"required"`
+	Frequency ScheduleFrequency `json:"frequency"`
+	EndAt     *time.Time        `json:"endAt"`
+}
+
+// TransferSchedule is a standing order. RunAt is the occurrence waiting to be sent,
+// NextAttemptAt is when the scheduler tries it next, later than RunAt while retrying.
+// Skipped counts the occurrences passed over while the schedule was paused.
+type TransferSchedule struct {
+	ID            int               `json:"id"`
+	AccountNumber int64             `json:"accountNumber"`
+	ToAccount     int64             `json:"toAccount"`
+	Amount        Money             `json:"amount"`
+	Frequency     ScheduleFrequency `json:"frequency"`
+	StartAt       time.Time         `json:"startAt"`
+	EndAt         *time.Time        `json:"endAt,omitempty"`
+	Status        ScheduleStatus    `json:"status"`
+	RunAt         time.Time         `json:"runAt"`
+	NextAttemptAt time.Time         `json:"nextAttemptAt"`
+	Attempts      int               `json:"attempts"`
+	Runs          int               `json:"runs"`
+	Skipped       int               `json:"skipped"`
+	LastError     string            `json:"lastError,omitempty"`
+	CreatedAt     time.Time         `json:"createdAt"`
+	UpdatedAt     time.Time         `json:"updatedAt"`
+}
+
+const (
+	RunCompleted = "completed"
+	RunFailed    = "failed"
+)
+
+// ScheduleRun is one attempt at sending a schedule's occurrence
+type ScheduleRun struct {
+	ID           int       `json:"id"`
+	ScheduleID   int       `json:"scheduleId"`
+	ScheduledFor time.Time `json:"scheduledFor"`
+	Attempt      int       `json:"attempt"`
+	Status       string    `json:"status"`
+	Error        string    `json:"error,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+func (t *TransferSchedule) transferRequest() *TransferRequest {
+	return &TransferRequest{ToAccount: t.ToAccount, Amount: t.Amount.Amount, Currency: t.Amount.Currency}
+}
+
+// occurrence is the n-th time a schedule starting at start is due, counting from 0.
+// Monthly schedules stay on the same day of the month, or the last day for short months.
+func occurrence(start time.Time, frequency ScheduleFrequency, n int) time.Time {
+	switch frequency {
+	case FrequencyDaily:
+		return start.AddDate(0, 0, n)
+	case FrequencyWeekly:
+		return start.AddDate(0, 0, 7*n)
+	case FrequencyMonthly:
+		first := time.Date(start.Year(), start.Month()+time.Month(n), 1, start.Hour(), start.Minute(), start.Second(), start.Nanosecond(), start.Location())
+		lastDay := first.AddDate(0, 1, -1).Day()
+		return first.AddDate(0, 0, min(start.Day(), lastDay)-1)
+	}
+	return start
+}
+
+// recordScheduleRun updates schedule after an attempt at schedule.RunAt, err being why it failed.
+// It returns the run to store. A failed attempt is retried with exponential backoff until
+// maxScheduleAttempts, after which the occurrence is given up and the schedule moves on.
+func recordScheduleRun(schedule *TransferSchedule, err error, now time.Time) *ScheduleRun {
+	run := &ScheduleRun{
+		ScheduleID:   schedule.ID,
+		ScheduledFor: schedule.RunAt,
+		Attempt:      schedule.Attempts + 1,
+		Status:       RunCompleted,
+		CreatedAt:    now,
+	}
+	schedule.UpdatedAt = now
+
+	if err != nil {
+		run.Status = RunFailed
+		run.Error = err.Error()
+		schedule.Attempts++
+		schedule.LastError = run.Error
+
+		if schedule.Attempts < maxScheduleAttempts {
+			delay := min(scheduleRetryDelay<<(schedule.Attempts-1), maxScheduleRetry)
+			schedule.NextAttemptAt = now.Add(delay)
+			return run
+		}
+	} else {
+		schedule.LastError = ""
+	}
+
+	schedule.Runs++
+	schedule.Attempts = 0
+
+	next := occurrence(schedule.StartAt, schedule.Frequency, schedule.Runs+schedule.Skipped)
+
+	switch {
+	case schedule.Frequency == FrequencyOnce && err != nil:
+		schedule.Status = ScheduleFailed
+	case schedule.Frequency == FrequencyOnce, schedule.EndAt != nil && next.After(*schedule.EndAt):
+		schedule.Status = ScheduleCompleted
+	default:
+		schedule.RunAt = next
+		schedule.NextAttemptAt = next
+	}
+
+	return run
+}
+
+// changeScheduleStatus moves schedule to status, which CanBecome has allowed
+func changeScheduleStatus(schedule *TransferSchedule, status ScheduleStatus, now time.Time) {
+	resuming := schedule.Status == SchedulePaused && status == ScheduleActive
+
+	schedule.Status = status
+	schedule.UpdatedAt = now
+
+	if resuming {
+		skipMissedOccurrences(schedule, now)
+	}
+}
+
+// skipMissedOccurrences moves a resumed schedule on to its first occurrence after now.
+// Customers pause standing orders to stop payments, so what fell due meanwhile is not
+// sent in a burst afterwards. A one-off schedule has nothing later and goes out right away.
+func skipMissedOccurrences(schedule *TransferSchedule, now time.Time) {
+	if schedule.Frequency == FrequencyOnce || schedule.RunAt.After(now) {
+		return
+	}
+
+	n := schedule.Runs + schedule.Skipped
+	for !occurrence(schedule.StartAt, schedule.Frequency, n).After(now) {
+		n++
+	}
+
+	next := occurrence(schedule.StartAt, schedule.Frequency, n)
+
+	schedule.Skipped = n - schedule.Runs
+	schedule.Attempts = 0
+	schedule.LastError = ""
+
+	if schedule.EndAt != nil && next.After(*schedule.EndAt) {
+		schedule.Status = ScheduleCompleted
+		return
+	}
+
+	schedule.RunAt = next
+	schedule.NextAttemptAt = next
+}
+
+// runScheduler sends due schedules every interval until ctx is cancelled. Each run is
+// claimed and executed in a single storage transaction, so an occurrence is sent exactly
+// once even with several servers or a crash half way.
+func (s *APIServer) runScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		s.runDueSchedules(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *APIServer) runDueSchedules(ctx context.Context) {
+	now := time.Now().UTC()
+
+	ids, err := s.store.GetDueSchedules(ctx, now, scheduleBatchSize)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Println("finding due schedules:", err)
+		}
+		return
+	}
+
+	for _, id := range ids {
+		run, err := s.store.RunSchedule(ctx, id, now, s.rates)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("running schedule %d: %v\n", id, err)
+			}
+			continue
+		}
+
+		if run != nil && run.Status == RunFailed {
+			log.Printf("schedule %d attempt %d failed: %s\n", id, run.Attempt, run.Error)
+		}
+	}
+}
+
+func (s *APIServer) handleCreateSchedule(w http.ResponseWriter, r *http.Request) error {
+	req := new(ScheduleRequest)
+	if err := decodeJSON(w, r, req); err != nil {
+		return err
+	}
+
+	if req.Frequency == "" {
+		req.Frequency = FrequencyOnce
+	}
+
+	if !req.Frequency.Valid() {
+		return validationError(fmt.Sprintf("frequency should be %s, %s, %s or %s", FrequencyOnce, FrequencyDaily, FrequencyWeekly, FrequencyMonthly))
+	}
+
+	now := time.Now().UTC()
+	start := req.StartAt.UTC()
+
+	if !start.After(now) {
+		return validationError("startAt should be in the future")
+	}
+
+	// end_at is a timestamp without time zone, an offset would be dropped rather than applied
+	var end *time.Time
+	if req.EndAt != nil {
+		utc := req.EndAt.UTC()
+		end = &utc
+	}
+
+	if end != nil && end.Before(start) {
+		return validationError("endAt should not be before startAt")
+	}
+
+	caller := callerFromContext(r.Context())
+
+	if req.ToAccount == caller.Number {
+		return ErrSelfTransfer
+	}
+
+	if req.Currency != caller.Balance.Currency {
+		return ErrCurrencyMismatch
+	}
+
+	if _, err := s.store.GetAccountByAccNumber(r.Context(), req.ToAccount); err != nil {
+		return err
+	}
+
+	// the code is checked once here, the scheduler sends every occurrence without one
+	if err := s.requireStepUp(w, r, req.Money()); err != nil {
+		return err
+	}
+
+	schedule, err := s.store.CreateSchedule(r.Context(), &TransferSchedule{
+		AccountNumber: caller.Number,
+		ToAccount:     req.ToAccount,
+		Amount:        req.Money(),
+		Frequency:     req.Frequency,
+		StartAt:       start,
+		EndAt:         end,
+		Status:        ScheduleActive,
+		RunAt:         start,
+		NextAttemptAt: start,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	})
+	if err != nil {
+		return err
+	}
+
+	return WriteJson(w, http.StatusCreated, schedule)
+}
+
+func (s *APIServer) handleGetSchedules(w http.ResponseWriter, r *http.Request) error {
+	caller := callerFromContext(r.Context())
+
+	schedules, err := s.store.GetSchedules(r.Context(), caller.Number)
+	if err != nil {
+		return err
+	}
+
+	return WriteJson(w, http.StatusOK, schedules)
+}
+
+func (s *APIServer) handleGetSchedule(w http.ResponseWriter, r *http.Request) error {
+	schedule, err := s.callerSchedule(r)
+	if err != nil {
+		return err
+	}
+
+	return WriteJson(w, http.StatusOK, schedule)
+}
+
+// handleGetScheduleRuns lists every attempt of the schedule, failed ones with their error
+func (s *APIServer) handleGetScheduleRuns(w http.ResponseWriter, r *http.Request) error {
+	schedule, err := s.callerSchedule(r)
+	if err != nil {
+		return err
+	}
+
+	runs, err := s.store.GetScheduleRuns(r.Context(), schedule.ID)
+	if err != nil {
+		return err
+	}
+
+	return WriteJson(w, http.StatusOK, runs)
+}
+
+func (s *APIServer) handlePauseSchedule(w http.ResponseWriter, r *http.Request) error {
+	return s.handleScheduleStatus(w, r, SchedulePaused)
+}
+
+// handleResumeSchedule reactivates a paused schedule, occurrences missed while paused are skipped
+func (s *APIServer) handleResumeSchedule(w http.ResponseWriter, r *http.Request) error {
+	return s.handleScheduleStatus(w, r, ScheduleActive)
+}
+
+func (s *APIServer) handleCancelSchedule(w http.ResponseWriter, r *http.Request) error {
+	return s.handleScheduleStatus(w, r, ScheduleCancelled)
+}
+
+func (s *APIServer) handleScheduleStatus(w http.ResponseWriter, r *http.Request, status ScheduleStatus) error {
+	schedule, err := s.callerSchedule(r)
+	if err != nil {
+		return err
+	}
+
+	schedule, err = s.store.UpdateScheduleStatus(r.Context(), schedule.ID, status)
+	if err != nil {
+		return err
+	}
+
+	return WriteJson(w, http.StatusOK, schedule)
+}
+
+// callerSchedule loads the {id} schedule, other accounts' schedules look like they don't exist
+func (s *APIServer) callerSchedule(r *http.Request) (*TransferSchedule, error) {
+	id, err := getID(r)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule, err := s.store.GetSchedule(r.Context(), id)
+	if err != nil {
+		return nil, err
+	}
+
+	caller := callerFromContext(r.Context())
+	if schedule.AccountNumber != caller.Number && caller.Role != RoleAdmin {
+		return nil, ErrScheduleNotFound
+	}
+
+	return schedule, nil
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Statement is an account's activity over [From, To). Closing is only known once every
+// line has been read.
+type Statement struct {
+	Account *Account
+	From    time.Time
+	To      time.Time
+	Opening Money
+	Closing Money
+}
+
+// StatementLine is one ledger entry seen from the statement's account. Amount is signed,
+// negative for money leaving, and in the account's currency like Balance after it.
+type StatementLine struct {
+	Transaction *Transaction
+	Amount      Money
+	Balance     Money
+}
+
+// StatementWriter renders a statement while the store reads it, so a long period is never
+// held in memory. Begin is called once with the opening balance, Line for every entry in
+// order, and End once with the closing balance.
+type StatementWriter interface {
+	Begin(*Statement) error
+	Line(*StatementLine) error
+	End(*Statement) error
+}
+
+// netAmount is how much t changed the balance of account number, in that account's currency
+func (t *Transaction) netAmount(number int64) int64 {
+	var net int64
+	if t.ToAccount == number {
+		if t.Credited != nil {
+			net += t.Credited.Amount
+		} else {
+			net += t.Amount.Amount
+		}
+	}
+	if t.FromAccount == number {
+		net -= t.Amount.Amount
+	}
+	return net
+}
+
+// nextStatementLine moves the statement's running balance past t
+func nextStatementLine(statement *Statement, balance Money, t *Transaction) *StatementLine {
+	amount := NewMoney(t.netAmount(statement.Account.Number), balance.Currency)
+	return &StatementLine{
+		Transaction: t,
+		Amount:      amount,
+		Balance:     NewMoney(balance.Amount+amount.Amount, balance.Currency),
+	}
+}
+
+// statementRoute names the statement route, it runs under StatementTimeout instead of
+// RequestTimeout since a long period takes a while to stream
+const statementRoute = "statement"
+
+// requestTimeout is the deadline withRequestTimeout gives r
+func (s *APIServer) requestTimeout(r *http.Request) time.Duration {
+	if route := mux.CurrentRoute(r); route != nil && route.GetName() == statementRoute {
+		return s.config.StatementTimeout
+	}
+	return s.config.RequestTimeout
+}
+
+var statementFormats = map[string]struct {
+	contentType string
+	extension   string
+	writer      func(io.Writer) StatementWriter
+}{
+	"csv":  {"text/csv; charset=utf-8", "csv", newCSVStatement},
+	"json": {"application/json", "json", newJSONStatement},
+	"ofx":  {"application/x-ofx", "ofx", newOFXStatement},
+}
+
+// handleGetStatement streams the account's statement for ?from=&to= as csv (the default),
+// json or ofx. to defaults to now.
+func (s *APIServer) handleGetStatement(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	query := r.URL.Query()
+
+	formatName := query.Get("format")
+	if formatName == "" {
+		formatName = "csv"
+	}
+
+	format, ok := statementFormats[formatName]
+	if !ok {
+		return validationError("format should be csv, json or ofx")
+	}
+
+	if query.Get("from") == "" {
+		return validationError("from is required")
+	}
+
+	from, err := parseDate(query.Get("from"), false)
+	if err != nil {
+		return validationError("invalid from date")
+	}
+
+	to := time.Now().UTC()
+	if query.Get("to") != "" {
+		if to, err = parseDate(query.Get("to"), true); err != nil {
+			return validationError("invalid to date")
+		}
+	}
+
+	if !from.Before(to) {
+		return validationError("from should be before to")
+	}
+
+	// a stream keeps its database connection for as long as the client takes to read it,
+	// a few slow downloads must not be able to starve every other request of one
+	select {
+	case s.statements <- struct{}{}:
+		defer func() { <-s.statements }()
+	default:
+		w.Header().Set("Retry-After", "30")
+		return newAPIError(http.StatusServiceUnavailable, CodeTooManyStatements, "too many statements are being downloaded, try again shortly")
+	}
+
+	// the server's WriteTimeout is meant for ordinary responses
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(s.config.StatementTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+
+	// headers go out with the first write, after that a failure can only cut the response
+	// short, which the client sees as a broken download rather than a complete file
+	out := &statementResponse{ResponseWriter: w, header: func(h http.Header) {
+		h.Set("Content-Type", format.contentType)
+		h.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="statement-%d-%s.%s"`, id, from.Format("20060102"), format.extension))
+	}}
+
+	err = s.store.GetStatement(r.Context(), id, from, to, format.writer(out))
+	if err != nil && out.started {
+		log.Printf("statement for account %d failed half way: %v\n", id, err)
+		panic(http.ErrAbortHandler)
+	}
+
+	return err
+}
+
+// statementResponse sets the statement headers on the first write, so failures before
+// any output still get a normal JSON error
+type statementResponse struct {
+	http.ResponseWriter
+	header  func(http.Header)
+	started bool
+}
+
+func (w *statementResponse) Write(p []byte) (int, error) {
+	if !w.started {
+		w.started = true
+		w.header(w.Header())
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+type csvStatement struct {
+	w *csv.Writer
+}
+
+func newCSVStatement(w io.Writer) StatementWriter {
+	return &csvStatement{w: csv.NewWriter(w)}
+}
+
+func (c *csvStatement) Begin(s *Statement) error {
+	c.w.Write([]string{"date", "type", "id", "counterparty", "amount", "currency", "rate", "balance"})
+	return c.row(s.From, "opening_balance", "", "", "", "", s.Opening)
+}
+
+func (c *csvStatement) Line(l *StatementLine) error {
+	t := l.Transaction
+
+	counterparty := t.FromAccount
+	if l.Amount.Amount < 0 {
+		counterparty = t.ToAccount
+	}
+
+	party := ""
+	if counterparty != 0 {
+		party = strconv.FormatInt(counterparty, 10)
+	}
+
+	return c.row(t.CreatedAt, t.Type, strconv.Itoa(t.ID), party, l.Amount.Decimal(), t.Rate, l.Balance)
+}
+
+func (c *csvStatement) End(s *Statement) error {
+	if err := c.row(s.To, "closing_balance", "", "", "", "", s.Closing); err != nil {
+		return err
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func (c *csvStatement) row(at time.Time, kind, id, party, amount, rate string, balance Money) error {
+	c.w.Write([]string{at.Format(time.RFC3339), kind, id, party, amount, string(balance.Currency), rate, balance.Decimal()})
+	return c.w.Error()
+}
+
+type jsonStatement struct {
+	w     io.Writer
+	first bool
+}
+
+func newJSONStatement(w io.Writer) StatementWriter {
+	return &jsonStatement{w: w, first: true}
+}
+
+type jsonStatementLine struct {
+	*Transaction
+	Change  Money `json:"change"`
+	Balance Money `json:"balance"`
+}
+
+func (j *jsonStatement) Begin(s *Statement) error {
+	return j.fields(`{`, map[string]any{
+		"account":        s.Account.Number,
+		"currency":       s.Opening.Currency,
+		"from":           s.From,
+		"to":             s.To,
+		"openingBalance": s.Opening,
+	}, `,"transactions":[`)
+}
+
+func (j *jsonStatement) Line(l *StatementLine) error {
+	data, err := json.Marshal(jsonStatementLine{Transaction: l.Transaction, Change: l.Amount, Balance: l.Balance})
+	if err != nil {
+		return err
+	}
+
+	if !j.first {
+		if _, err := io.WriteString(j.w, ","); err != nil {
+			return err
+		}
+	}
+	j.first = false
+
+	_, err = j.w.Write(data)
+	return err
+}
+
+func (j *jsonStatement) End(s *Statement) error {
+	return j.fields(`],`, map[string]any{"closingBalance": s.Closing}, "}\n")
+}
+
+// fields writes the members of v without its braces between prefix and suffix
+func (j *jsonStatement) fields(prefix string, v map[string]any, suffix string) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(j.w, prefix+string(data[1:len(data)-1])+suffix)
+	return err
+}
+
+// ofxBankID identifies this service in BANKACCTFROM, OFX allows at most 9 characters
+const ofxBankID = "BANKAPI"
+
+type ofxStatement struct {
+	w io.Writer
+}
+
+func newOFXStatement(w io.Writer) StatementWriter {
+	return &ofxStatement{w: w}
+}
+
+func ofxDate(t time.Time) string {
+	return t.UTC().Format("20060102150405")
+}
+
+func ofxEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// Begin writes an OFX 2.2 statement response up to the transaction list
+func (o *ofxStatement) Begin(s *Statement) error {
+	_, err := fmt.Fprintf(o.w, `<?xml version="1.0" encoding="UTF-8"?>
+<?OFX OFXHEADER="200" VERSION="220" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>
+<OFX>
+<SIGNONMSGSRSV1><SONRS><STATUS><CODE>0</CODE><SEVERITY>INFO</SEVERITY></STATUS><DTSERVER>%s</DTSERVER><LANGUAGE>ENG</LANGUAGE></SONRS></SIGNONMSGSRSV1>
+<BANKMSGSRSV1><STMTTRNRS><TRNUID>0</TRNUID><STATUS><CODE>0</CODE><SEVERITY>INFO</SEVERITY></STATUS>
+<STMTRS><CURDEF>%s</CURDEF>
+<BANKACCTFROM><BANKID>%s</BANKID><ACCTID>%d</ACCTID><ACCTTYPE>CHECKING</ACCTTYPE></BANKACCTFROM>
+<BANKTRANLIST><DTSTART>%s</DTSTART><DTEND>%s</DTEND>
+`, ofxDate(time.Now()), s.Opening.Currency, ofxBankID, s.Account.Number, ofxDate(s.From), ofxDate(s.To))
+	return err
+}
+
+func (o *ofxStatement) Line(l *StatementLine) error {
+	t := l.Transaction
+
+	kind, name := "XFER", ""
+	switch {
+	case t.Type == TransactionDeposit:
+		kind = "DEP"
+	case t.Type == TransactionWithdrawal:
+		kind = "DEBIT"
+	case l.Amount.Amount < 0:
+		name = fmt.Sprintf("Transfer to %d", t.ToAccount)
+	default:
+		name = fmt.Sprintf("Transfer from %d", t.FromAccount)
+	}
+
+	memo := ""
+	if t.Rate != "" {
+		memo = fmt.Sprintf("<MEMO>%s at rate %s</MEMO>", ofxEscape(t.Amount.String()), t.Rate)
+	}
+
+	if name != "" {
+		name = "<NAME>" + ofxEscape(name) + "</NAME>"
+	}
+
+	_, err := fmt.Fprintf(o.w, "<STMTTRN><TRNTYPE>%s</TRNTYPE><DTPOSTED>%s</DTPOSTED><TRNAMT>%s</TRNAMT><FITID>%d</FITID>%s%s</STMTTRN>\n",
+		kind, ofxDate(t.CreatedAt), l.Amount.Decimal(), t.ID, name, memo)
+	return err
+}
+
+func (o *ofxStatement) End(s *Statement) error {
+	_, err := fmt.Fprintf(o.w, `</BANKTRANLIST>
+<LEDGERBAL><BALAMT>%s</BALAMT><DTASOF>%s</DTASOF></LEDGERBAL>
+</STMTRS></STMTTRNRS></BANKMSGSRSV1>
+</OFX>
+`, s.Closing.Decimal(), ofxDate(s.To))
+	return err
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	jwtIssuer       = "bankapi"
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 7 * 24 * time.Hour
+
+	// challengeTTL is how long a challenge token from a two-factor login stays usable
+	challengeTTL = 5 * time.Minute
+
+	// purposeTwoFactor marks a challenge token, it only buys a try at the second factor
+	purposeTwoFactor = "2fa"
+)
+
+var ErrRefreshTokenNotFound = errors.New("refresh token not found")
+
+// AccountClaims are the claims of an access token, the subject is the account number.
+// Purpose is empty for access tokens and set for tokens that may only be used for one step.
+type AccountClaims struct {
+	AccountNumber int64  `json:"accountNumber"`
+	Role          Role   `json:"role"`
+	Purpose       string `json:"purpose,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// RefreshToken is kept server side so it can be rotated and revoked, only its hash is stored
+type RefreshToken struct {
+	TokenHash     string
+	AccountNumber int64
+	ExpiresAt     time.Time
+	CreatedAt     time.Time
+	RevokedAt     *time.Time
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken" validate:"required"`
+}
+
+type TokenResponse struct {
+	Token        string    `json:"token"`
+	RefreshToken string    `json:"refreshToken,omitempty"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+}
+
+// validateJWT checks an access token, challenge tokens are refused
+func validateJWT(tokenString string, secret []byte) (*AccountClaims, error) {
+	return parseJWT(tokenString, secret, "")
+}
+
+func validateChallengeJWT(tokenString string, secret []byte) (*AccountClaims, error) {
+	return parseJWT(tokenString, secret, purposeTwoFactor)
+}
+
+func parseJWT(tokenString string, secret []byte, purpose string) (*AccountClaims, error) {
+
+	claims := new(AccountClaims)
+
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		// Don't forget to validate the alg is what you expect:
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		return secret, nil
+	},
+		jwt.WithIssuer(jwtIssuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Subject != strconv.FormatInt(claims.AccountNumber, 10) {
+		return nil, fmt.Errorf("token subject does not match account")
+	}
+
+	if claims.Purpose != purpose {
+		return nil, fmt.Errorf("token is meant for %q, not %q", claims.Purpose, purpose)
+	}
+
+	return claims, nil
+}
+
+func createJWT(account *Account, secret []byte) (string, time.Time, error) {
+	return signJWT(account, secret, "", accessTokenTTL)
+}
+
+func createChallengeJWT(account *Account, secret []byte) (string, time.Time, error) {
+	return signJWT(account, secret, purposeTwoFactor, challengeTTL)
+}
+
+func signJWT(account *Account, secret []byte, purpose string, ttl time.Duration) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+
+	claims := &AccountClaims{
+		AccountNumber: account.Number,
+		Role:          account.Role,
+		Purpose:       purpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    jwtIssuer,
+			Subject:   strconv.FormatInt(account.Number, 10),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
+	tokenString, err := token.SignedString(secret)
+	return tokenString, expiresAt, err
+}
+
+// issueTokens creates an access token and a fresh refresh token for account
+func (s *APIServer) issueTokens(ctx context.Context, account *Account) (*TokenResponse, error) {
+
+	tokenString, expiresAt, err := createJWT(account, s.jwtSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	refreshToken := base64.RawURLEncoding.EncodeToString(raw)
+
+	now := time.Now().UTC()
+	err = s.store.CreateRefreshToken(ctx, &RefreshToken{
+		TokenHash:     hashRefreshToken(refreshToken),
+		AccountNumber: account.Number,
+		ExpiresAt:     now.Add(refreshTokenTTL),
+		CreatedAt:     now,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenResponse{Token: tokenString, RefreshToken: refreshToken, ExpiresAt: expiresAt}, nil
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// handleRefreshToken swaps a refresh token for a new access and refresh token pair.
+// Each refresh token works once, presenting a used one again revokes every token of the account.
+func (s *APIServer) handleRefreshToken(w http.ResponseWriter, r *http.Request) error {
+
+	req := new(RefreshRequest)
+	if err := decodeJSON(w, r, req); err != nil {
+		return err
+	}
+
+	hash := hashRefreshToken(req.RefreshToken)
+
+	stored, err := s.store.GetRefreshToken(r.Context(), hash)
+	if err != nil {
+		return err
+	}
+
+	if time.Now().After(stored.ExpiresAt) {
+		return newAPIError(http.StatusUnauthorized, CodeInvalidRefreshToken, "refresh token expired")
+	}
+
+	revoked, err := s.store.RevokeRefreshToken(r.Context(), hash)
+	if err != nil {
+		return err
+	}
+
+	if !revoked {
+		log.Println("refresh token reused for account", stored.AccountNumber)
+		if err := s.store.RevokeAccountRefreshTokens(r.Context(), stored.AccountNumber); err != nil {
+			return err
+		}
+		return newAPIError(http.StatusUnauthorized, CodeInvalidRefreshToken, "invalid refresh token")
+	}
+
+	account, err := s.store.GetAccountByAccNumber(r.Context(), stored.AccountNumber)
+	if err != nil {
+		return newAPIError(http.StatusUnauthorized, CodeInvalidRefreshToken, "invalid refresh token")
+	}
+
+	tokens, err := s.issueTokens(r.Context(), account)
+	if err != nil {
+		return err
+	}
+
+	return WriteJson(w, http.StatusOK, tokens)
+}
+
+// handleLogout revokes the given refresh token, the access token simply runs out
+func (s *APIServer) handleLogout(w http.ResponseWriter, r *http.Request) error {
+
+	req := new(RefreshRequest)
+	if err := decodeJSON(w, r, req); err != nil {
+		return err
+	}
+
+	if _, err := s.store.RevokeRefreshToken(r.Context(), hashRefreshToken(req.RefreshToken)); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TOTP parameters, RFC 6238 defaults since authenticator apps ignore anything else
+const (
+	totpPeriod     = 30
+	totpDigits     = 6
+	totpSecretSize = 20
+
+	// totpSkew is how many periods either side of now a code is accepted, for clock drift
+	totpSkew = 1
+
+	totpIssuer = "BankAPI"
+
+	recoveryCodeCount = 10
+
+	// stepUpHeader carries the TOTP code for transfers above the step-up threshold
+	stepUpHeader = "X-OTP"
+)
+
+var (
+	ErrTwoFactorNotEnrolled = errors.New("two-factor authentication is not set up")
+	ErrTwoFactorEnabled     = errors.New("two-factor authentication is already enabled")
+	ErrInvalidOTP           = errors.New("invalid or already used code")
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TwoFactor is an account's TOTP enrollment. It only counts once ConfirmedAt is set,
+// LastCounter is the time step of the last accepted code so no code works twice.
+type TwoFactor struct {
+	AccountNumber int64
+	Secret        string
+	ConfirmedAt   *time.Time
+	LastCounter   int64
+	CreatedAt     time.Time
+}
+
+func (t *TwoFactor) Enabled() bool {
+	return t != nil && t.ConfirmedAt != nil
+}
+
+type OTPRequest struct {
+	Code string `json:"code" validate:"required"`
+}
+
+// TwoFactorLoginRequest finishes a login, Code is a TOTP code or a recovery code
+type TwoFactorLoginRequest struct {
+	ChallengeToken string `json:"challengeToken" validate:"required"`
+	Code           string `json:"code" validate:"required"`
+}
+
+type EnrollmentResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauthUri"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// ChallengeResponse is what a correct password gets when the account has two-factor enabled
+type ChallengeResponse struct {
+	TwoFactorRequired bool      `json:"twoFactorRequired"`
+	ChallengeToken    string    `json:"challengeToken"`
+	ExpiresAt         time.Time `json:"expiresAt"`
+}
+
+func newTOTPSecret() (string, error) {
+	raw := make([]byte, totpSecretSize)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base32NoPadding.EncodeToString(raw), nil
+}
+
+// totpURI is the otpauth:// key URI authenticator apps read from a QR code
+func totpURI(secret string, number int64) string {
+	label := totpIssuer + ":" + strconv.FormatInt(number, 10)
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {totpIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {strconv.Itoa(totpDigits)},
+		"period":    {strconv.Itoa(totpPeriod)},
+	}
+	u := url.URL{Scheme: "otpauth", Host: "totp", Path: "/" + label, RawQuery: query.Encode()}
+	return u.String()
+}
+
+// totpCode is the HOTP value (RFC 4226) of key for counter
+func totpCode(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// matchTOTP returns the time step code belongs to around now, false if it matches none
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := base32NoPadding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for counter := current - totpSkew; counter <= current+totpSkew; counter++ {
+		if hmac.Equal([]byte(totpCode(key, counter)), []byte(code)) {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// newRecoveryCodes returns codes to show the customer once and the hashes to store
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32NoPadding.EncodeToString(raw))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode ignores case and dashes, people retype these by hand
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// enabledTwoFactor returns the account's confirmed enrollment, nil if it has none
+func (s *APIServer) enabledTwoFactor(ctx context.Context, number int64) (*TwoFactor, error) {
+	tf, err := s.store.GetTwoFactor(ctx, number)
+	if errors.Is(err, ErrTwoFactorNotEnrolled) || (err == nil && !tf.Enabled()) {
+		return nil, nil
+	}
+	return tf, err
+}
+
+// checkSecondFactor accepts a TOTP code for tf, or when allowRecovery a recovery code.
+// Every try is reserved as a failed login of the account and the client like a password
+// is, so guessing runs into the same backoff and wrong codes keep counting.
+func (s *APIServer) checkSecondFactor(w http.ResponseWriter, r *http.Request, tf *TwoFactor, code string, allowRecovery bool) error {
+	keys := loginKeys(r, tf.AccountNumber)
+
+	reservations, err := s.reserveLoginAttempt(r.Context(), w, keys)
+	if err != nil {
+		return err
+	}
+
+	ok, err := s.useSecondFactor(r.Context(), tf, code, allowRecovery)
+	if err != nil {
+		s.releaseLoginAttempt(r.Context(), reservations)
+		return err
+	}
+
+	if !ok {
+		return ErrInvalidOTP
+	}
+
+	s.releaseLoginAttempt(r.Context(), reservations)
+	return nil
+}
+
+func (s *APIServer) useSecondFactor(ctx context.Context, tf *TwoFactor, code string, allowRecovery bool) (bool, error) {
+	if counter, ok := matchTOTP(tf.Secret, code, time.Now()); ok {
+		return s.store.UseTOTPCounter(ctx, tf.AccountNumber, counter)
+	}
+
+	if !allowRecovery || len(code) == totpDigits {
+		return false, nil
+	}
+
+	return s.store.UseRecoveryCode(ctx, tf.AccountNumber, hashRecoveryCode(code), time.Now().UTC())
+}
+
+// requireStepUp asks for a fresh TOTP code in the X-OTP header when amount is above the
+// step-up threshold, converted to the default currency. Without a rate the code is always
+// asked for, and accounts without two-factor can't move that much at all.
+func (s *APIServer) requireStepUp(w http.ResponseWriter, r *http.Request, amount Money) error {
+	threshold := NewMoney(int64(s.config.StepUpThreshold), DefaultCurrency)
+	if threshold.Amount <= 0 {
+		return nil
+	}
+
+	if converted, _, err := s.rates.Convert(amount, DefaultCurrency); err == nil && converted.Amount <= threshold.Amount {
+		return nil
+	}
+
+	caller := callerFromContext(r.Context())
+
+	tf, err := s.enabledTwoFactor(r.Context(), caller.Number)
+	if err != nil {
+		return err
+	}
+
+	if tf == nil {
+		return newAPIError(http.StatusForbidden, CodeTwoFactorRequired, fmt.Sprintf("transfers above %s need two-factor authentication to be enabled", threshold))
+	}
+
+	code := r.Header.Get(stepUpHeader)
+	if code == "" {
+		return newAPIError(http.StatusForbidden, CodeTwoFactorRequired, fmt.Sprintf("transfers above %s need a current TOTP code in the %s header", threshold, stepUpHeader))
+	}
+
+	return s.checkSecondFactor(w, r, tf, code, false)
+}
+
+// handleEnrollTwoFactor starts a new enrollment, replacing one that was never confirmed.
+// The secret is only shown here, two-factor is off until it is confirmed with a code.
+func (s *APIServer) handleEnrollTwoFactor(w http.ResponseWriter, r *http.Request) error {
+	caller := callerFromContext(r.Context())
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return err
+	}
+
+	err = s.store.SaveTwoFactor(r.Context(), &TwoFactor{
+		AccountNumber: caller.Number,
+		Secret:        secret,
+		CreatedAt:     time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return WriteJson(w, http.StatusCreated, EnrollmentResponse{Secret: secret, URI: totpURI(secret, caller.Number)})
+}
+
+// handleConfirmTwoFactor turns two-factor on with a code from the new secret and hands out
+// the recovery codes, the only time they can be seen
+func (s *APIServer) handleConfirmTwoFactor(w http.ResponseWriter, r *http.Request) error {
+	req := new(OTPRequest)
+	if err := decodeJSON(w, r, req); err != nil {
+		return err
+	}
+
+	caller := callerFromContext(r.Context())
+
+	tf, err := s.store.GetTwoFactor(r.Context(), caller.Number)
+	if err != nil {
+		return err
+	}
+
+	if tf.Enabled() {
+		return ErrTwoFactorEnabled
+	}
+
+	counter, ok := matchTOTP(tf.Secret, req.Code, time.Now())
+	if !ok {
+		return ErrInvalidOTP
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	tf.ConfirmedAt = &now
+	tf.LastCounter = counter
+
+	if err := s.store.ConfirmTwoFactor(r.Context(), tf, hashes); err != nil {
+		return err
+	}
+
+	return WriteJson(w, http.StatusOK, RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// handleDisableTwoFactor turns two-factor off, the owner proves it with a TOTP or recovery code
+func (s *APIServer) handleDisableTwoFactor(w http.ResponseWriter, r *http.Request) error {
+	req := new(OTPRequest)
+	if err := decodeJSON(w, r, req); err != nil {
+		return err
+	}
+
+	caller := callerFromContext(r.Context())
+
+	tf, err := s.store.GetTwoFactor(r.Context(), caller.Number)
+	if err != nil {
+		return err
+	}
+
+	if tf.Enabled() {
+		if err := s.checkSecondFactor(w, r, tf, req.Code, true); err != nil {
+			return err
+		}
+	}
+
+	if err := s.store.DeleteTwoFactor(r.Context(), caller.Number); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handleTwoFactorLogin finishes a login started by handleLogin with the challenge token and
+// a TOTP or recovery code
+func (s *APIServer) handleTwoFactorLogin(w http.ResponseWriter, r *http.Request) error {
+	req := new(TwoFactorLoginRequest)
+	if err := decodeJSON(w, r, req); err != nil {
+		return err
+	}
+
+	claims, err := validateChallengeJWT(req.ChallengeToken, s.jwtSecret)
+	if err != nil {
+		return unauthorized("invalid or expired challenge token")
+	}
+
+	tf, err := s.enabledTwoFactor(r.Context(), claims.AccountNumber)
+	if err != nil {
+		return err
+	}
+
+	account, err := s.store.GetAccountByAccNumber(r.Context(), claims.AccountNumber)
+	if errors.Is(err, ErrAccountNotFound) || (err == nil && account.Status == StatusClosed) || tf == nil {
+		return ErrInvalidCredentials
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := s.checkSecondFactor(w, r, tf, req.Code, true); err != nil {
+		return err
+	}
+
+	if err := s.store.ResetLoginAttempts(r.Context(), loginKeys(r, account.Number)[0].key); err != nil {
+		return err
+	}
+
+	tokens, err := s.issueTokens(r.Context(), account)
+	if err != nil {
+		return err
+	}
+
+	return WriteJson(w, http.StatusOK, tokens)
+}
@@ -2,52 +2,241 @@ package main
 
 import (
 	"log"
-	"math/rand"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
 type LoginRequest struct {
-	Number   int64  `json:"number"`
-	Password string `json:"password"`
+	Number   int64  `json:"number" validate:"required,luhn"`
+	Password string `json:"password" validate:"required,max=72"`
 }
 
+// Amount is in the minor units of Currency, which has to be the sending account's currency
 type TransferRequest struct {
-	ToAccount int64 `json:"toAccount"`
-	Amount    int64 `json:"amount"`
+	ToAccount int64    `json:"toAccount" validate:"required,luhn"`
+	Amount    int64    `json:"amount" validate:"positive"`
+	Currency  Currency `json:"currency" validate:"required,currency"`
 }
 
+func (r *TransferRequest) Money() Money {
+	return NewMoney(r.Amount, r.Currency)
+}
+
+type AmountRequest struct {
+	Amount   int64    `json:"amount" validate:"positive"`
+	Currency Currency `json:"currency" validate:"required,currency"`
+}
+
+func (r *AmountRequest) Money() Money {
+	return NewMoney(r.Amount, r.Currency)
+}
+
+// OverdraftLimit is how far below zero a withdrawal or transfer may take a balance
+const OverdraftLimit int64 = 0
+
+// passwords are capped at 72 bytes since bcrypt ignores anything past that
 type CreateAccountRequest struct {
-	FirstName string `json:"firstName"`
-	LastName  string `json:"lastName"`
-	Password string `json:"password"`
+	FirstName string   `json:"firstName" validate:"required,max=50"`
+	LastName  string   `json:"lastName" validate:"required,max=50"`
+	Password  string   `json:"password" validate:"min=6,max=72"`
+	Currency  Currency `json:"currency" validate:"currency"`
+}
+
+const (
+	TransactionTransfer   = "transfer"
+	TransactionDeposit    = "deposit"
+	TransactionWithdrawal = "withdrawal"
+
+	TransactionCompleted = "completed"
+)
+
+// Transaction is a ledger entry, FromAccount is 0 for money coming in and ToAccount is 0 for money going out.
+// Amount is what left or entered the account. For a cross-currency transfer Credited is what
+// ToAccount received and Rate the exchange rate applied.
+type Transaction struct {
+	ID          int       `json:"id"`
+	FromAccount int64     `json:"fromAccount,omitempty"`
+	ToAccount   int64     `json:"toAccount,omitempty"`
+	Amount      Money     `json:"amount"`
+	Credited    *Money    `json:"credited,omitempty"`
+	Rate        string    `json:"rate,omitempty"`
+	Type        string    `json:"type"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+type TransactionFilter struct {
+	From   time.Time
+	To     time.Time
+	Limit  int
+	Offset int
+}
+
+type AccountSort string
+
+const (
+	SortCreatedAt AccountSort = "created_at"
+	SortBalance   AccountSort = "balance"
+	SortName      AccountSort = "name"
+)
+
+func (s AccountSort) Valid() bool {
+	return s == SortCreatedAt || s == SortBalance || s == SortName
+}
+
+// AccountFilter narrows GET /account, a nil field or empty string doesn't filter
+type AccountFilter struct {
+	NamePrefix string
+	Status     AccountStatus
+	Currency   Currency
+	MinBalance *int64
+	MaxBalance *int64
+	Sort       AccountSort
+	Desc       bool
+	After      *AccountCursor
+	Limit      int
+}
+
+// AccountCursor is the position of the last account on a page. It is only valid
+// for the sort and direction it was made with.
+type AccountCursor struct {
+	Sort      AccountSort `json:"sort"`
+	Desc      bool        `json:"desc,omitempty"`
+	ID        int         `json:"id"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Balance   int64       `json:"balance"`
+	LastName  string      `json:"lastName"`
+	FirstName string      `json:"firstName"`
+}
+
+func newAccountCursor(account *Account, filter *AccountFilter) *AccountCursor {
+	return &AccountCursor{
+		Sort:      filter.Sort,
+		Desc:      filter.Desc,
+		ID:        account.ID,
+		CreatedAt: account.CreatedAt,
+		Balance:   account.Balance.Amount,
+		LastName:  account.LastName,
+		FirstName: account.FirstName,
+	}
+}
+
+// AccountPage is one page of accounts, Total counts every match across all pages
+type AccountPage struct {
+	Accounts []*Account
+	Total    int
+	Next     *AccountCursor
+}
+
+type Role string
+
+const (
+	RoleCustomer Role = "customer"
+	RoleTeller   Role = "teller"
+	RoleAdmin    Role = "admin"
+)
+
+func (r Role) Valid() bool {
+	return r == RoleCustomer || r == RoleTeller || r == RoleAdmin
+}
+
+type RoleRequest struct {
+	Role Role `json:"role" validate:"required"`
+}
+
+type AccountStatus string
+
+const (
+	StatusActive AccountStatus = "active"
+	StatusFrozen AccountStatus = "frozen"
+	StatusClosed AccountStatus = "closed"
+)
+
+// accountTransitions lists where each status may move, closed is final
+var accountTransitions = map[AccountStatus][]AccountStatus{
+	StatusActive: {StatusFrozen, StatusClosed},
+	StatusFrozen: {StatusActive, StatusClosed},
+	StatusClosed: {},
+}
+
+func (s AccountStatus) CanBecome(next AccountStatus) bool {
+	for _, allowed := range accountTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+type StatusChangeRequest struct {
+	Reason string `json:"reason" validate:"required,max=200"`
 }
 
 type Account struct {
 	ID        int       `json:"id"`
 	FirstName string    `json:"firstName"`
-	LastName  string    `json:"secondName"`
+	LastName  string    `json:"lastName"`
 	Number    int64     `json:"number"`
 	EncryptedPassword string `json:"-"`
-	Balance   int64     `json:"balance"`
+	Balance   Money     `json:"balance"`
 	CreatedAt time.Time `json:"createdAt"`
+	Role      Role      `json:"role"`
+	Version   int       `json:"version"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	Status          AccountStatus `json:"status"`
+	StatusReason    string        `json:"statusReason,omitempty"`
+	StatusChangedAt *time.Time    `json:"statusChangedAt,omitempty"`
+}
+
+// UpdateAccountRequest is a partial update, fields left out keep their value
+type UpdateAccountRequest struct {
+	FirstName *string `json:"firstName" validate:"required,max=50"`
+	LastName  *string `json:"lastName" validate:"required,max=50"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword" validate:"required,max=72"`
+	NewPassword     string `json:"newPassword" validate:"min=6,max=72"`
+}
+
+// AccountUpdate lists the columns to change, nil fields are left alone
+type AccountUpdate struct {
+	FirstName         *string
+	LastName          *string
+	EncryptedPassword *string
 }
 
-func NewAccount(firstname string, lastname string, password string) *Account {
+// passwordCost is the bcrypt cost passwords are stored with, tests lower it to keep logins fast
+var passwordCost = bcrypt.DefaultCost
 
-	encryptedPass, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+func NewAccount(firstname string, lastname string, password string, currency Currency) *Account {
+
+	encryptedPass, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
 	if err != nil {
 		log.Println(err)
 		return nil
 	}
 
+	number, err := generateAccountNumber()
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	now := time.Now().UTC()
+
 	return &Account{
 		FirstName: firstname,
 		LastName:  lastname,
-		Number:    int64(rand.Intn(10000000)),
+		Number:    number,
 		EncryptedPassword: string(encryptedPass),
-		Balance:   0,
-		CreatedAt: time.Now().UTC(),
+		Balance:   NewMoney(0, currency),
+		CreatedAt: now,
+		Role:      RoleCustomer,
+		Version:   1,
+		UpdatedAt: now,
+		Status:    StatusActive,
 	}
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxBodyBytes caps every JSON request body
+const maxBodyBytes = 64 << 10
+
+// decodeJSON reads a single JSON object from the body into v, rejecting unknown fields
+// and oversized bodies, then checks v's validate tags
+func decodeJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(v); err != nil {
+		return decodeError(err)
+	}
+
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		return validationError("request body should contain a single JSON object")
+	}
+
+	return validate(v)
+}
+
+func decodeError(err error) error {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return newAPIError(http.StatusRequestEntityTooLarge, CodeRequestTooLarge, fmt.Sprintf("request body should be at most %d bytes", maxErr.Limit))
+	}
+
+	// encoding/json has no typed error for unknown fields
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		apiErr := validationError("request contains unknown fields")
+		apiErr.Fields = map[string]string{strings.Trim(field, `"`): "is not allowed"}
+		return apiErr
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		apiErr := validationError("request has fields of the wrong type")
+		apiErr.Fields = map[string]string{typeErr.Field: "should be a " + typeErr.Type.String()}
+		return apiErr
+	}
+
+	return err
+}
+
+// validate checks the `validate` struct tags of v, a comma separated list of
+//
+//	required   non-zero value, non-blank for strings
+//	min=N      strings at least N characters, numbers at least N
+//	max=N      strings at most N characters, numbers at most N
+//	positive   numbers greater than 0
+//	luhn       account numbers ending in a valid Luhn check digit, legacy 7 digit ones pass
+//	currency   supported ISO 4217 codes, empty strings pass
+//
+// Pointer fields are optional: nil skips the rules, anything else is checked by value.
+// Embedded structs are checked as if their fields were declared inline.
+// Every failing field is reported under its JSON name.
+func validate(v any) error {
+	val := reflect.Indirect(reflect.ValueOf(v))
+	if val.Kind() != reflect.Struct {
+		return nil
+	}
+
+	fields := map[string]string{}
+	validateFields(val, fields)
+
+	if len(fields) == 0 {
+		return nil
+	}
+
+	apiErr := validationError("request validation failed")
+	apiErr.Fields = fields
+	return apiErr
+}
+
+func validateFields(val reflect.Value, fields map[string]string) {
+	typ := val.Type()
+
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			validateFields(val.Field(i), fields)
+			continue
+		}
+
+		tag := field.Tag.Get("validate")
+		if tag == "" {
+			continue
+		}
+
+		if msg := checkField(val.Field(i), tag); msg != "" {
+			fields[jsonName(field)] = msg
+		}
+	}
+}
+
+// checkField returns why value breaks the rules in tag, or "" when it is valid
+func checkField(value reflect.Value, tag string) string {
+	if value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			return ""
+		}
+		value = value.Elem()
+	}
+
+	for _, rule := range strings.Split(tag, ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+
+		switch name {
+		case "required":
+			if value.IsZero() || (value.Kind() == reflect.String && strings.TrimSpace(value.String()) == "") {
+				return "is required"
+			}
+		case "min":
+			n := ruleArg(rule, arg)
+			if value.Kind() == reflect.String && utf8.RuneCountInString(value.String()) < n {
+				return fmt.Sprintf("should have at least %d characters", n)
+			}
+			if isInt(value) && value.Int() < int64(n) {
+				return fmt.Sprintf("should be at least %d", n)
+			}
+		case "max":
+			n := ruleArg(rule, arg)
+			if value.Kind() == reflect.String && utf8.RuneCountInString(value.String()) > n {
+				return fmt.Sprintf("should have at most %d characters", n)
+			}
+			if isInt(value) && value.Int() > int64(n) {
+				return fmt.Sprintf("should be at most %d", n)
+			}
+		case "positive":
+			if isInt(value) && value.Int() <= 0 {
+				return "should be greater than 0"
+			}
+		case "luhn":
+			if isInt(value) && !validAccountNumber(value.Int()) {
+				return "is not a valid account number"
+			}
+		case "currency":
+			if value.Kind() == reflect.String && value.String() != "" && !Currency(value.String()).Valid() {
+				return "is not a supported ISO 4217 currency"
+			}
+		default:
+			panic(fmt.Sprintf("unknown validation rule %q", rule))
+		}
+	}
+
+	return ""
+}
+
+func ruleArg(rule string, arg string) int {
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		panic(fmt.Sprintf("validation rule %q needs a number", rule))
+	}
+	return n
+}
+
+func isInt(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return field.Name
+	}
+	return name
+}